@@ -3,12 +3,17 @@ package main
 import (
 	"encoding/json"
 	"os"
+
+	"github.com/stellviaproject/dbmap/pgsync"
+	"github.com/stellviaproject/dbmap/pgutil"
 )
 
 type Config struct {
 	SourceDB  DataBase
 	DestinyDB DataBase
 	Tables    []string
+	Sync      pgsync.Options
+	Lint      pgutil.LintConfig
 }
 
 func (cfg *Config) Load(fileName string) error {
@@ -46,5 +51,8 @@ func (cfg *Config) Example() {
 			SSLMode:  "disable",
 		},
 		Tables: []string{"table1", "table2"},
+		Lint: pgutil.LintConfig{
+			Prefixes: []string{"tb_", "nom_", "r_"},
+		},
 	}
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stellviaproject/dbmap/database"
 )
 
 type DataBase struct {
@@ -37,6 +41,12 @@ func (db *DataBase) Connect() (*sql.DB, error) {
 	return sqlDB, nil
 }
 
+// Conectar con un pool de pgx para leer con COPY ... TO STDOUT, ver database.DataBase.CopyConnect
+func (db *DataBase) CopyConnect(ctx context.Context) (*pgxpool.Pool, error) {
+	copyDB := database.DataBase(*db)
+	return copyDB.CopyConnect(ctx)
+}
+
 func (db *DataBase) PgDSN() string {
 	if db.SSLMode == "" {
 		return fmt.Sprintf("host=%s user=%s password=%s dbname=postgres port=%d", db.Host, db.User, db.Password, db.Port)
@@ -82,7 +92,7 @@ func (db *DataBase) CreateDB(pgDB *sql.DB) error {
 	}
 
 	// Crear la base de datos
-	query := fmt.Sprintf("CREATE DATABASE %s", db.Name)
+	query := fmt.Sprintf("CREATE DATABASE %s", database.QuoteIdent(db.Name))
 	_, err := pgDB.Exec(query)
 	if err != nil {
 		return fmt.Errorf("error al crear la base de datos '%s': %v", db.Name, err)
@@ -1,8 +1,11 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type DataBase struct {
@@ -37,6 +40,30 @@ func (db *DataBase) Connect() (*sql.DB, error) {
 	return sqlDB, nil
 }
 
+// Conectar con un pool de pgx, que a diferencia de lib/pq permite leer con COPY ... TO STDOUT.
+// Las fechas se escriben en formato ISO, los reales con todos sus dígitos y bytea en hexadecimal, igual que los lee lib/pq
+func (db *DataBase) CopyConnect(ctx context.Context) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(db.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("error al leer la configuración de la conexión: %v", err)
+	}
+	config.ConnConfig.RuntimeParams["datestyle"] = "ISO, YMD"
+	config.ConnConfig.RuntimeParams["extra_float_digits"] = "3"
+	config.ConnConfig.RuntimeParams["bytea_output"] = "hex"
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir la conexión con la base de datos: %v", err)
+	}
+
+	// Verificar que la conexión sea válida
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("error al verificar la conexión con la base de datos: %v", err)
+	}
+
+	return pool, nil
+}
+
 func (db *DataBase) PgDSN() string {
 	if db.SSLMode == "" {
 		return fmt.Sprintf("host=%s user=%s password=%s dbname=postgres port=%d", db.Host, db.User, db.Password, db.Port)
@@ -82,7 +109,7 @@ func (db *DataBase) CreateDB(pgDB *sql.DB) error {
 	}
 
 	// Crear la base de datos
-	query := fmt.Sprintf("CREATE DATABASE %s", db.Name)
+	query := fmt.Sprintf("CREATE DATABASE %s", QuoteIdent(db.Name))
 	_, err := pgDB.Exec(query)
 	if err != nil {
 		return fmt.Errorf("error al crear la base de datos '%s': %v", db.Name, err)
@@ -0,0 +1,32 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Retorna el identificador (esquema, tabla, columna o base de datos) entre comillas dobles,
+// escapando las comillas que contenga, para usarlo de forma segura en una consulta SQL
+func QuoteIdent(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+// Recibe el nombre de una tabla en la forma scheme.table y retorna "scheme"."table",
+// si el nombre no tiene esquema retorna solo "table"
+func QuoteTable(tableName string) string {
+	scheme, name, ok := strings.Cut(tableName, ".")
+	if !ok {
+		return QuoteIdent(tableName)
+	}
+	return QuoteIdent(scheme) + "." + QuoteIdent(name)
+}
+
+// Retorna la lista de identificadores entre comillas separados por coma
+func QuoteIdentList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = QuoteIdent(name)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 
 	_ "github.com/lib/pq" // Controlador de PostgreSQL
 	"github.com/stellviaproject/dbmap/pgsync"
@@ -10,6 +15,17 @@ import (
 )
 
 func main() {
+	lint := flag.Bool("lint", false, "revisa la estructura de la base de datos origen y muestra los problemas en JSON")
+	resume := flag.Bool("resume", false, "continúa la última sincronización interrumpida desde el archivo de estado")
+	fixture := flag.String("catalog", "", "archivo JSON con la estructura de la base de datos origen, si se omite se consulta la base de datos")
+	dryRun := flag.Bool("dry-run", false, "muestra lo que haría la sincronización sin escribir en la base de datos destino")
+	format := flag.String("format", "text", "formato del plan de -dry-run: text o json")
+	create := flag.Bool("create", false, "crea en la base de datos destino los esquemas y tablas que faltan antes de copiar")
+	flag.Parse()
+	if *format != "text" && *format != "json" {
+		log.Fatalf("unknown plan format %s", *format)
+	}
+
 	config := Config{}
 	if _, err := os.Stat("./config.json"); err != nil {
 		config.Example()
@@ -21,28 +37,105 @@ func main() {
 			log.Fatalln(err)
 		}
 	}
+	if *resume {
+		config.Sync.Resume = true
+	}
+	if *create {
+		config.Sync.CreateTables = true
+	}
+	// El secreto del enmascaramiento puede venir del entorno para no guardarlo en config.json
+	if config.Sync.MaskSecret == "" {
+		config.Sync.MaskSecret = os.Getenv("DBMAP_MASK_SECRET")
+	}
 	src, err := config.SourceDB.Connect()
 	if err != nil {
 		log.Fatalln(err)
 	}
+	var catalog pgutil.Catalog = pgutil.NewPgCatalog(src)
+	if *fixture != "" {
+		if catalog, err = pgutil.LoadFixtureCatalog(*fixture); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *lint {
+		runLint(catalog, &config)
+		return
+	}
 	pg, err := config.DestinyDB.PgConnect()
 	if err != nil {
 		log.Fatalln(err)
 	}
 	if !config.DestinyDB.HasDB(pg) {
+		if *dryRun {
+			log.Fatalf("destination database %s does not exist", config.DestinyDB.Name)
+		}
 		if err := config.DestinyDB.CreateDB(pg); err != nil {
 			log.Fatalln(err)
 		}
+		// La base de datos recién creada está vacía, las tablas se crean desde el modelo del origen
+		config.Sync.CreateTables = true
 	}
 	dst, err := config.DestinyDB.Connect()
 	if err != nil {
 		log.Fatalln(err)
 	}
-	info, err := pgutil.GetDataBaseInfo(src)
+	// Cancelar las copias en curso con Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	// En modo COPY el origen se lee con COPY TO STDOUT, que necesita conexiones pgx
+	if config.Sync.Bulk && !*dryRun {
+		pool, err := config.SourceDB.CopyConnect(ctx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer pool.Close()
+		config.Sync.CopySource = pool
+	}
+	if *dryRun {
+		runPlan(ctx, src, dst, catalog, &config, *format)
+		return
+	}
+	if err := pgsync.SyncTablesContext(ctx, src, dst, config.Tables, catalog, &config.Sync); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Revisa la base de datos origen con las reglas de la configuracion y termina con error si hay problemas graves
+func runLint(catalog pgutil.Catalog, config *Config) {
+	info, err := catalog.GetDataBaseInfo()
 	if err != nil {
 		log.Fatalln(err)
 	}
-	if err := pgsync.SyncTables(src, dst, config.Tables, info); err != nil {
+	lintConfig := config.Lint
+	lintConfig.Configs = [][]string{config.Tables}
+	report := pgutil.Lint(info, &lintConfig)
+	data, err := report.JSON()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(string(data))
+	if report.HasErrors() {
+		os.Exit(1)
+	}
+}
+
+// Muestra el plan de la sincronización en el formato pedido y termina con error si alguna tabla no puede copiarse
+func runPlan(ctx context.Context, src, dst *sql.DB, catalog pgutil.Catalog, config *Config, format string) {
+	plan, err := pgsync.PlanSync(ctx, src, dst, config.Tables, catalog, &config.Sync)
+	if err != nil {
 		log.Fatalln(err)
 	}
+	switch format {
+	case "json":
+		data, err := plan.JSON()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(string(data))
+	default:
+		fmt.Print(plan)
+	}
+	if plan.HasErrors() {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,326 @@
+package pgsync
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lib/pq"
+	"github.com/stellviaproject/dbmap/database"
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Nombre de la tabla temporal del destino donde se cargan los lotes en modo COPY
+const stageTable = "dbmap_stage"
+
+// Lee hasta size filas, retorna un lote vacío cuando no quedan filas
+func readBatch(rows *sql.Rows, columns, size int) ([][]interface{}, error) {
+	batch := [][]interface{}{}
+	for len(batch) < size && rows.Next() {
+		values := make([]interface{}, columns)
+		valuePtrs := make([]interface{}, columns)
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		batch = append(batch, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error fetching rows: %w", err)
+	}
+	return batch, nil
+}
+
+// Retorna true si las filas del origen se leen con COPY ... TO STDOUT: en modo COPY con conexiones pgx al origen.
+// Un plan y la segunda fase de la carga no escriben con COPY y leen con SELECT
+func (ts *tableSync) copyOut() bool {
+	return ts.opts != nil && ts.opts.Bulk && ts.opts.CopySource != nil && ts.plan == nil && !ts.backfilling
+}
+
+// Lee las filas del rango del origen con una sola consulta COPY ... TO STDOUT y las escribe por lotes igual que
+// syncRange, desde la última clave copiada si se reanuda. Con instantánea la lectura se hace en una transacción que la importa
+func (ts *tableSync) copyRange(ctx context.Context, index int, r keyRange, label string) error {
+	table := ts.table
+	lower := keyText(r.from)
+	if r.lastKey != nil {
+		lower = keyText(r.lastKey)
+	}
+	query := table.CopyKeyRangeQuery(ts.keys, lower, keyText(r.to), r.lastKey != nil, ts.conditions...)
+
+	conn, err := ts.opts.CopySource.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("error acquiring source connection: %w", err)
+	}
+	defer conn.Release()
+	if ts.opts.SnapshotID != "" {
+		tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+		if err != nil {
+			return fmt.Errorf("error beginning read transaction: %w", err)
+		}
+		defer tx.Rollback(context.Background())
+		if _, err := tx.Exec(ctx, "SET TRANSACTION SNAPSHOT "+pq.QuoteLiteral(ts.opts.SnapshotID)); err != nil {
+			return fmt.Errorf("error importing snapshot %s: %w", ts.opts.SnapshotID, err)
+		}
+	}
+
+	// COPY escribe las filas en el pipe mientras se leen y se escriben en el destino por lotes
+	pr, pw := io.Pipe()
+	copied := make(chan error, 1)
+	go func() {
+		_, err := conn.Conn().PgConn().CopyTo(ctx, pw, query)
+		pw.CloseWithError(err)
+		copied <- err
+	}()
+	err = ts.readCopyRange(ctx, &copyReader{reader: bufio.NewReader(pr), columns: table.Columns}, index, label)
+	// Si la escritura falla se cierra el pipe para que COPY termine
+	pr.CloseWithError(err)
+	copyErr := <-copied
+	if err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return fmt.Errorf("error copying rows from %s: %w", table.TableName(), copyErr)
+	}
+	if state := ts.progressState(); state != nil {
+		return state.FinishRange(table.TableName(), index)
+	}
+	return nil
+}
+
+// Escribe por lotes las filas del rango que devuelve COPY ... TO STDOUT
+func (ts *tableSync) readCopyRange(ctx context.Context, cr *copyReader, index int, label string) error {
+	batchSize := ts.opts.batchSize()
+	rangeRows := 0
+	for {
+		batch, err := cr.readBatch(batchSize)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		rangeRows += len(batch)
+		if err := ts.writeRangeBatch(ctx, index, batch, rangeRows, label); err != nil {
+			return err
+		}
+	}
+}
+
+// Lector de las filas que escribe COPY ... TO STDOUT en formato de texto: una fila por línea, los valores
+// separados por tabuladores, \N es NULL y los caracteres especiales se escapan con barra invertida
+type copyReader struct {
+	reader  *bufio.Reader
+	columns []pgutil.ColumnInfo //Columnas de las filas, en su orden
+}
+
+// Lee hasta size filas con los mismos tipos que devuelve lib/pq con SELECT, retorna un lote vacío cuando no quedan filas
+func (cr *copyReader) readBatch(size int) ([][]interface{}, error) {
+	batch := [][]interface{}{}
+	for len(batch) < size {
+		line, err := cr.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error fetching rows: %w", err)
+		}
+		if line == "" {
+			break
+		}
+		fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+		if len(fields) != len(cr.columns) {
+			return nil, fmt.Errorf("copy row has %d values for %d columns", len(fields), len(cr.columns))
+		}
+		values := make([]interface{}, len(fields))
+		for i, field := range fields {
+			if field == `\N` {
+				continue
+			}
+			if values[i], err = copyOutValue(cr.columns[i], copyUnescape(field)); err != nil {
+				return nil, fmt.Errorf("error reading column %s: %w", cr.columns[i].Name, err)
+			}
+		}
+		batch = append(batch, values)
+	}
+	return batch, nil
+}
+
+// Quita los escapes de un valor del formato de texto de COPY
+func copyUnescape(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var sb strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] != '\\' || i+1 == len(field) {
+			sb.WriteByte(field[i])
+			continue
+		}
+		i++
+		switch c := field[i]; c {
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'v':
+			sb.WriteByte('\v')
+		case 'x':
+			// \xh o \xhh, un byte en hexadecimal
+			end := i + 1
+			for end < len(field) && end < i+3 && isHexDigit(field[end]) {
+				end++
+			}
+			if end == i+1 {
+				sb.WriteByte(c)
+				continue
+			}
+			n, _ := strconv.ParseUint(field[i+1:end], 16, 8)
+			sb.WriteByte(byte(n))
+			i = end - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// \d, \dd o \ddd, un byte en octal
+			end := i + 1
+			for end < len(field) && end < i+3 && field[end] >= '0' && field[end] <= '7' {
+				end++
+			}
+			n, _ := strconv.ParseUint(field[i:end], 8, 8)
+			sb.WriteByte(byte(n))
+			i = end - 1
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// Convierte el texto de un valor de COPY al tipo que devuelve lib/pq al leer la columna con SELECT,
+// los tipos que lib/pq no convierte quedan como []byte
+func copyOutValue(column pgutil.ColumnInfo, text string) (interface{}, error) {
+	switch column.DataType {
+	case "smallint", "integer", "bigint":
+		return strconv.ParseInt(text, 10, 64)
+	case "real":
+		return strconv.ParseFloat(text, 32)
+	case "double precision":
+		return strconv.ParseFloat(text, 64)
+	case "boolean":
+		return text == "t", nil
+	case "character varying", "text":
+		return text, nil
+	case "bytea":
+		return hex.DecodeString(strings.TrimPrefix(text, `\x`))
+	case "date", "timestamp without time zone", "timestamp with time zone":
+		return pq.ParseTimestamp(nil, text)
+	case "time without time zone":
+		return time.Parse("15:04:05", text)
+	}
+	return []byte(text), nil
+}
+
+// Escribe el lote en modo COPY: las filas se cargan con COPY FROM STDIN en una tabla temporal del destino,
+// se anulan las claves foráneas sin fila referenciada y se mezclan con la tabla destino con INSERT ... ON CONFLICT.
+// De las filas con la misma clave primaria se carga la última, ver dedupeKeys.
+// Si nullMissing es false las claves foráneas se dejan como vienen del origen
+func copyBatch(ctx context.Context, dst destination, table *pgutil.TableInfo, batch [][]interface{}, nullMissing bool) error {
+	tx, err := dst.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+	batch = dedupeKeys(table, batch)
+
+	columns := table.ColumnNames()
+	stage := &pgutil.TableInfo{Scheme: "pg_temp", Name: stageTable, Columns: table.Columns}
+	createQuery := fmt.Sprintf(
+		"CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA",
+		database.QuoteIdent(stageTable), database.QuoteIdentList(columns), table.QuotedName(),
+	)
+	if _, err := tx.ExecContext(ctx, createQuery); err != nil {
+		return fmt.Errorf("error creating stage table for %s: %w", table.TableName(), err)
+	}
+
+	copyStmt, err := tx.PrepareContext(ctx, pq.CopyInSchema(stage.Scheme, stage.Name, columns...))
+	if err != nil {
+		return fmt.Errorf("error preparing copy statement: %w", err)
+	}
+	for _, values := range batch {
+		for i, column := range table.Columns {
+			values[i] = copyValue(column, values[i])
+		}
+		if _, err := copyStmt.ExecContext(ctx, values...); err != nil {
+			copyStmt.Close()
+			return fmt.Errorf("error copying record: %w", err)
+		}
+	}
+	// Exec sin argumentos termina el COPY y devuelve los errores pendientes
+	if _, err := copyStmt.ExecContext(ctx); err != nil {
+		copyStmt.Close()
+		return fmt.Errorf("error copying records: %w", err)
+	}
+	if err := copyStmt.Close(); err != nil {
+		return fmt.Errorf("error closing copy statement: %w", err)
+	}
+
+	// Verificar las claves foráneas y actualizar valores inexistentes a NULL
+	for _, fk := range table.Constraints {
+		if !nullMissing {
+			break
+		}
+		if _, err := tx.ExecContext(ctx, nullMissingFKQuery(stage, table, fk)); err != nil {
+			return fmt.Errorf("error checking foreign key %s: %w", fk.Name, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, stage.UpSertQuery(table.TableName())); err != nil {
+		return fmt.Errorf("error merging records into %s: %w", table.TableName(), err)
+	}
+	// En la transacción única ON COMMIT DROP llega tarde, el siguiente lote vuelve a crear la tabla temporal
+	if _, err := tx.ExecContext(ctx, "DROP TABLE "+stage.QuotedName()); err != nil {
+		return fmt.Errorf("error dropping stage table for %s: %w", table.TableName(), err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// lib/pq codifica los []byte como bytea en COPY, pero el driver también devuelve []byte
+// para tipos como numeric o uuid, que deben enviarse como texto
+func copyValue(column pgutil.ColumnInfo, value interface{}) interface{} {
+	if data, ok := value.([]byte); ok && column.DataType != "bytea" {
+		return string(data)
+	}
+	return value
+}
+
+// Retorna la consulta que pone en NULL las claves foráneas de la tabla temporal cuya fila referenciada
+// no existe en el destino, si la referencia es a la misma tabla también se busca en el lote
+func nullMissingFKQuery(stage, table *pgutil.TableInfo, fk pgutil.FKConstraintInfo) string {
+	local := database.QuoteIdent(fk.Local)
+	referenced := database.QuoteIdent(fk.Referenced)
+	query := fmt.Sprintf(
+		"UPDATE %s AS s SET %s = NULL WHERE s.%s IS NOT NULL AND NOT EXISTS (SELECT 1 FROM %s AS r WHERE r.%s = s.%s)",
+		stage.QuotedName(), local, local, database.QuoteTable(fk.ReferencedTable), referenced, local,
+	)
+	if fk.ReferencedTable == table.TableName() {
+		query += fmt.Sprintf(" AND NOT EXISTS (SELECT 1 FROM %s AS b WHERE b.%s = s.%s)", stage.QuotedName(), referenced, local)
+	}
+	return query
+}
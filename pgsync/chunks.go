@@ -0,0 +1,118 @@
+package pgsync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Claves de muestra que se leen por cada parte en que se divide la tabla
+const samplesPerChunk = 100
+
+// Rango de claves [from, to) de una parte de la tabla, nil significa sin límite
+type keyRange struct {
+	from    []interface{}
+	to      []interface{}
+	lastKey []interface{} //Clave de la última fila copiada al reanudar
+	done    bool          //El rango ya se copió
+}
+
+// Reconstruye los rangos guardados en el avance de una tabla
+func resumeRanges(progress []RangeProgress) []keyRange {
+	ranges := make([]keyRange, len(progress))
+	for i, r := range progress {
+		ranges[i] = keyRange{
+			from:    keyValues(r.From),
+			to:      keyValues(r.To),
+			lastKey: keyValues(r.LastKey),
+			done:    r.Done,
+		}
+	}
+	return ranges
+}
+
+// Retorna los parámetros de SelectKeyRangeQuery: el límite inferior (la última clave leída o el inicio del rango) y el superior
+func (r keyRange) args(lastKey []interface{}) []interface{} {
+	args := []interface{}{}
+	if lastKey != nil {
+		args = append(args, lastKey...)
+	} else {
+		args = append(args, r.from...)
+	}
+	return append(args, r.to...)
+}
+
+// Divide la tabla en hasta chunks rangos de claves con una cantidad parecida de filas. Los límites se eligen
+// de una muestra de las claves (TABLESAMPLE) cuyo tamaño se calcula con la estimación de filas de pg_class
+func splitKeyRanges(ctx context.Context, reader reader, table *pgutil.TableInfo, keys []string, chunks int) ([]keyRange, error) {
+	var estimated float64
+	err := reader.QueryRowContext(ctx, "SELECT reltuples FROM pg_class WHERE oid = $1::regclass", table.QuotedName()).Scan(&estimated)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching row estimate of %s: %w", table.TableName(), err)
+	}
+	// Sin estadísticas (reltuples <= 0) se leen todas las claves
+	percent := 100.0
+	if estimated > 0 {
+		percent = 100 * float64(chunks*samplesPerChunk) / estimated
+		if percent > 100 {
+			percent = 100
+		}
+	}
+
+	rows, err := reader.QueryContext(ctx, table.SampleKeysQuery(keys, percent))
+	if err != nil {
+		return nil, fmt.Errorf("error sampling keys of %s: %w", table.TableName(), err)
+	}
+	samples := [][]interface{}{}
+	for {
+		batch, err := readBatch(rows, len(keys), samplesPerChunk)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		samples = append(samples, batch...)
+	}
+	rows.Close()
+
+	// Tomar como límites las claves de la muestra que la dividen en partes iguales
+	ranges := []keyRange{}
+	var from []interface{}
+	for i := 1; i < chunks && len(samples) > 0; i++ {
+		to := samples[i*len(samples)/chunks]
+		if from != nil && fmt.Sprint(from) == fmt.Sprint(to) {
+			continue
+		}
+		ranges = append(ranges, keyRange{from: from, to: to})
+		from = to
+	}
+	return append(ranges, keyRange{from: from}), nil
+}
+
+// Copia los rangos a la vez, cada uno con su propio lector del origen
+func (ts *tableSync) syncRanges(ctx context.Context, ranges []keyRange) error {
+	// Los lotes de la transacción única comparten la conexión y se escriben de uno en uno
+	workers := len(ranges)
+	if ts.opts != nil && ts.opts.SingleTransaction {
+		workers = 1
+	}
+	return runConcurrently(ctx, workers, len(ranges), func(ctx context.Context, i int) error {
+		if ranges[i].done {
+			return nil
+		}
+		reader, closeReader, err := openReader(ctx, ts.src, ts.opts)
+		if err != nil {
+			return err
+		}
+		defer closeReader()
+		label := fmt.Sprintf("chunk %d/%d", i+1, len(ranges))
+		if err := ts.syncRange(ctx, reader, i, ranges[i], label); err != nil {
+			return err
+		}
+		fmt.Printf("Completed %s of table %s.%s\n", label, ts.table.Scheme, ts.table.Name)
+		return nil
+	})
+}
@@ -0,0 +1,176 @@
+package pgsync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Políticas para las filas cuya clave existe en el origen y en el destino
+const (
+	CONFLICT_SOURCE      = "source"      //Gana el origen, la fila del destino se actualiza (por defecto)
+	CONFLICT_DESTINATION = "destination" //Gana el destino, solo se insertan las filas nuevas
+	CONFLICT_NEWER       = "newer"       //Se actualiza solo si la columna ConflictColumn del origen es mayor que la del destino
+	CONFLICT_SKIP        = "skip"        //Gana el destino y se registra en el log la clave de la fila omitida
+	CONFLICT_CUSTOM      = "custom"      //Decide la ConflictFunc registrada en Options.Resolvers para la tabla
+)
+
+// ConflictFunc recibe la tabla del destino y las dos versiones de una fila con los valores en el orden de sus
+// columnas, y retorna la fila que se escribe, o nil para dejar la fila del destino sin cambios
+type ConflictFunc func(table *pgutil.TableInfo, source, destination []interface{}) ([]interface{}, error)
+
+// Política de conflictos de una tabla
+type conflictPolicy struct {
+	policy   string
+	column   int          //Posición de ConflictColumn en la tabla del destino, en CONFLICT_NEWER
+	resolver ConflictFunc //Función de CONFLICT_CUSTOM
+}
+
+// Retorna la política de conflictos de la tabla validada contra su tabla del destino
+func (opts *Options) conflictPolicy(table *pgutil.TableInfo, m *tableMapping) (*conflictPolicy, error) {
+	tableOpts := opts.table(table)
+	cp := &conflictPolicy{policy: tableOpts.Conflict, column: -1}
+	if opts != nil {
+		cp.resolver = opts.Resolvers[table.TableName()]
+	}
+	if cp.policy == "" {
+		cp.policy = CONFLICT_SOURCE
+		if cp.resolver != nil {
+			cp.policy = CONFLICT_CUSTOM
+		}
+	}
+	switch cp.policy {
+	case CONFLICT_SOURCE, CONFLICT_DESTINATION, CONFLICT_SKIP:
+	case CONFLICT_NEWER:
+		column, ok := opts.targetColumn(table.TableName(), tableOpts.ConflictColumn)
+		if tableOpts.ConflictColumn == "" || table.GetColumn(tableOpts.ConflictColumn) == nil || !ok {
+			return nil, fmt.Errorf("conflict policy newer of %s requires a copied conflict column", table.TableName())
+		}
+		cp.column = findColumnIndex(m.target.ColumnNames(), column)
+		if cp.column < 0 {
+			return nil, fmt.Errorf("conflict column %s of %s does not exist in destination", tableOpts.ConflictColumn, table.TableName())
+		}
+	case CONFLICT_CUSTOM:
+		if cp.resolver == nil {
+			return nil, fmt.Errorf("conflict policy custom of %s requires a resolver", table.TableName())
+		}
+	default:
+		return nil, fmt.Errorf("unknown conflict policy %s for table %s", cp.policy, table.TableName())
+	}
+	return cp, nil
+}
+
+// Retorna la fila que se escribe cuando la clave existe en los dos lados, o nil para dejar la del destino
+func (cp *conflictPolicy) resolve(table *pgutil.TableInfo, source, destination []interface{}) ([]interface{}, error) {
+	switch cp.policy {
+	case CONFLICT_DESTINATION, CONFLICT_SKIP:
+		return nil, nil
+	case CONFLICT_NEWER:
+		if isNewer(source[cp.column], destination[cp.column]) {
+			return source, nil
+		}
+		return nil, nil
+	case CONFLICT_CUSTOM:
+		return cp.resolver(table, source, destination)
+	}
+	return source, nil
+}
+
+// Retorna true si el valor del origen es mayor que el del destino, un valor NULL es menor que cualquier otro
+func isNewer(source, destination interface{}) bool {
+	if source == nil {
+		return false
+	}
+	if destination == nil {
+		return true
+	}
+	switch s := source.(type) {
+	case time.Time:
+		if d, ok := destination.(time.Time); ok {
+			return s.After(d)
+		}
+	case int64:
+		if d, ok := destination.(int64); ok {
+			return s > d
+		}
+	}
+	s, sErr := strconv.ParseFloat(valueText(source), 64)
+	d, dErr := strconv.ParseFloat(valueText(destination), 64)
+	if sErr == nil && dErr == nil {
+		return s > d
+	}
+	return strings.Compare(valueText(source), valueText(destination)) > 0
+}
+
+// Retorna las filas del destino con las mismas claves que las filas del lote, por el texto de su clave.
+// Las filas del lote tienen las columnas de la tabla del destino
+func (ts *tableSync) destinationRows(ctx context.Context, batch [][]interface{}) (map[string][]interface{}, error) {
+	m := ts.mapping
+	destination := map[string][]interface{}{}
+	size := keysPerQuery(len(m.keys), len(batch))
+	for start := 0; start < len(batch); start += size {
+		keys := [][]interface{}{}
+		for _, values := range batch[start:min(start+size, len(batch))] {
+			keys = append(keys, pickValues(values, m.keyIndexes))
+		}
+		rows, err := ts.dst.QueryContext(ctx, m.target.SelectByKeysQuery(m.keys, len(keys)), keyArgs(keys)...)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching destination rows of %s: %w", m.target.TableName(), err)
+		}
+		existing, err := readBatch(rows, len(m.target.Columns), len(keys))
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, values := range existing {
+			destination[rowText(pickValues(values, m.keyIndexes))] = values
+		}
+	}
+	return destination, nil
+}
+
+// Aplica la política de conflictos al lote con las columnas de la tabla del destino: quita las filas
+// que dejan la fila del destino sin cambios y reemplaza las que la política cambia
+func (ts *tableSync) resolveConflicts(ctx context.Context, batch [][]interface{}) ([][]interface{}, error) {
+	if ts.conflict.policy == CONFLICT_SOURCE {
+		return batch, nil
+	}
+	m := ts.mapping
+	destination, err := ts.destinationRows(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([][]interface{}, 0, len(batch))
+	for _, values := range batch {
+		key := pickValues(values, m.keyIndexes)
+		current, ok := destination[rowText(key)]
+		if !ok {
+			resolved = append(resolved, values)
+			continue
+		}
+		row, err := ts.conflict.resolve(m.target, values, current)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving conflict in %s: %w", m.target.TableName(), err)
+		}
+		if row != nil && len(row) != len(m.target.Columns) {
+			return nil, fmt.Errorf("conflict resolver returned a row of %s with %d values for %d columns", m.target.TableName(), len(row), len(m.target.Columns))
+		}
+		if row == nil {
+			if ts.conflict.policy == CONFLICT_SKIP {
+				log.Printf("conflict in %s: keeping destination row with key %s", m.target.TableName(), strings.Join(keyText(key), ", "))
+			}
+			// La segunda fase de la carga no debe completar las claves foráneas de la fila que se dejó
+			if len(ts.deferred) > 0 {
+				ts.opts.recordKept(ts.table.TableName(), key)
+			}
+			continue
+		}
+		resolved = append(resolved, row)
+	}
+	return resolved, nil
+}
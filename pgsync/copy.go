@@ -1,73 +1,169 @@
 package pgsync
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"sync/atomic"
 
+	"github.com/lib/pq"
+	"github.com/stellviaproject/dbmap/database"
 	"github.com/stellviaproject/dbmap/pgutil"
 )
 
-func SyncTables(src, dst *sql.DB, tables []string, info *pgutil.DataBaseInfo) error {
+// Copia las tablas de src a dst en orden de dependencias, la estructura de las tablas se obtiene del catalogo
+func SyncTables(src, dst *sql.DB, tables []string, catalog pgutil.Catalog, opts *Options) error {
+	return SyncTablesContext(context.Background(), src, dst, tables, catalog, opts)
+}
+
+// Igual que SyncTables, al cancelar el contexto se detienen todas las copias en curso
+func SyncTablesContext(ctx context.Context, src, dst *sql.DB, tables []string, catalog pgutil.Catalog, opts *Options) error {
+	info, err := catalog.GetDataBaseInfo()
+	if err != nil {
+		return err
+	}
 	//Mapear las tablas por sus esquemas
 	tableMap := map[string]*pgutil.TableInfo{}
 	for _, table := range info.Tables {
 		tableMap[fmt.Sprintf("%s.%s", table.Scheme, table.Name)] = table
 	}
-	//Mapear las tablas de la consulta y preparar una lista
-	localMap := map[string]*pgutil.TableInfo{}
+	//Preparar la lista de tablas de la consulta
+	selected := []*pgutil.TableInfo{}
 	for _, tableName := range tables {
-		table := tableMap[tableName]
-		localMap[tableName] = table
-	}
-	//Tablas sin dependencias de otras en la consulta
-	withoutDeps := []*pgutil.TableInfo{}
-	//Tablas con referencias a otras en la consulta
-	references := map[*pgutil.TableInfo][]*pgutil.TableInfo{}
-	queue := []*pgutil.TableInfo{}
-	//Llenar las tablas con referencias y las tablas sin dependencias
-	for _, table := range localMap {
-		refs := GetReferences(table, localMap) //Obtener referencias locales
-		if len(refs) > 0 {
-			//Agregar a la lista de referencias
-			references[table] = append(references[table], refs...)
-			queue = append(queue, table)
-		} else {
-			//Agregar a la lista de sin dependencias
-			withoutDeps = append(withoutDeps, table)
+		table, ok := tableMap[tableName]
+		if !ok {
+			return fmt.Errorf("table %s not found in catalog", tableName)
 		}
-	}
-	for _, table := range withoutDeps {
 		if err := CheckConstraints(table, tableMap); err != nil {
-			log.Fatalln(err)
+			return err
+		}
+		selected = append(selected, table)
+	}
+	opts = opts.withCatalog(tableMap)
+	if opts != nil && opts.SingleTransaction && (opts.StateFile != "" || opts.State != nil || opts.Resume) {
+		return fmt.Errorf("single transaction sync cannot save or resume progress from a state file")
+	}
+	//Agrupar las tablas por niveles, cada nivel solo depende de los anteriores
+	levels, opts, err := syncLevels(selected, opts)
+	if err != nil {
+		return err
+	}
+	//Cargar el estado de las ejecuciones anteriores, una sincronización que no se reanuda descarta el avance guardado
+	if opts, err = opts.withState(); err != nil {
+		return err
+	}
+	if state := opts.state(); state != nil && !opts.Resume {
+		if err := state.ResetProgress(); err != nil {
+			return err
 		}
-		if err := SyncTable(src, dst, table); err != nil {
+	}
+	//Leer todas las tablas desde una misma instantánea del origen
+	if opts != nil && opts.Snapshot && opts.SnapshotID == "" {
+		snapshot, err := ExportSnapshot(src)
+		if err != nil {
 			return err
 		}
+		defer snapshot.Close()
+		snapshotOpts := *opts
+		snapshotOpts.SnapshotID = snapshot.ID
+		opts = &snapshotOpts
+		log.Printf("reading source from snapshot %s", snapshot.ID)
+	}
+	//Avisar de las filas hijas que referencian filas que los filtros no copian
+	warnings, err := FilterWarnings(ctx, src, selected, opts)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		log.Printf("warning: %s", warning)
+	}
+	//Calcular las filas a copiar si se pidió un subconjunto
+	if opts, err = opts.withSubset(ctx, src, selected); err != nil {
+		return err
 	}
-	syncedTables := map[string]*pgutil.TableInfo{}
-	processed := map[string]*pgutil.TableInfo{}
-	for len(queue) > 0 {
-		current := queue[0]
-		log.Printf("trying to sync table %s.%s", current.Scheme, current.Name)
-		if err := CheckConstraints(current, tableMap); err != nil {
-			log.Fatalln(err)
+	//Crear en el destino las tablas que faltan antes de escribir en ellas
+	if opts != nil && opts.CreateTables {
+		if err := createMissingTables(ctx, dst, levels, opts); err != nil {
+			return err
 		}
-		if CanSync(current, syncedTables) {
-			syncedTables[fmt.Sprintf("%s.%s", current.Scheme, current.Name)] = current
-			log.Printf("sync table %s.%s", current.Scheme, current.Name)
-			if err := SyncTable(src, dst, current); err != nil {
-				return err
-			}
-		} else {
-			if _, ok := processed[current.Name]; ok {
-				return fmt.Errorf("infinite loop detected in table dependecies")
-			}
-			queue = append(queue, current)
-			log.Printf("table will sync later %s.%s", current.Scheme, current.Name)
-			processed[current.Name] = current
+	}
+	//Escribir en la base de datos, o en una transacción única que postgres valida al confirmarla
+	var target destination = dbDestination{DB: dst, replica: opts.replica()}
+	var tx *sql.Tx
+	if opts != nil && opts.SingleTransaction {
+		if tx, err = beginSingleTransaction(ctx, dst, opts); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		target = txDestination{tx}
+		txOpts := *opts
+		txOpts.Workers = 1
+		opts = &txOpts
+	}
+	//Suprimir los triggers del destino durante la carga, se restauran aunque la carga falle
+	restore, err := suppressTriggers(ctx, target, selected, opts)
+	if err != nil {
+		return err
+	}
+	err = loadLevels(ctx, src, target, levels, opts)
+	if restoreErr := restore(); err == nil {
+		err = restoreErr
+	}
+	if err != nil {
+		return err
+	}
+	if tx != nil {
+		if err := commitSingleTransaction(tx); err != nil {
+			return err
+		}
+	}
+	//La sincronización terminó, la próxima reanudación no tiene nada que continuar
+	if state := opts.state(); state != nil {
+		return state.ResetProgress()
+	}
+	return nil
+}
+
+// Agrupa las tablas por niveles de dependencias como las copia SyncTables. En la transacción única las restricciones
+// se validan al confirmar y un ciclo sin claves que acepten nulos se copia en un solo nivel. En la carga en dos fases
+// retorna las opciones con las claves foráneas diferidas de cada tabla
+func syncLevels(selected []*pgutil.TableInfo, opts *Options) ([][]*pgutil.TableInfo, *Options, error) {
+	levels, err := DependencyLevels(selected)
+	if err != nil {
+		if opts == nil || !opts.SingleTransaction {
+			return nil, nil, err
+		}
+		levels = [][]*pgutil.TableInfo{selected}
+	}
+	if opts != nil && opts.TwoPhase {
+		twoPhaseOpts := *opts
+		twoPhaseOpts.deferred = deferredKeys(levels)
+		twoPhaseOpts.phaseOne = &phaseOne{read: map[string]phaseOneRead{}, kept: map[string]map[string]bool{}}
+		opts = &twoPhaseOpts
+	}
+	return levels, opts, nil
+}
+
+// Copia los niveles en orden, completa las claves foráneas diferidas y borra las filas que ya no existen en el origen
+func loadLevels(ctx context.Context, src *sql.DB, dst destination, levels [][]*pgutil.TableInfo, opts *Options) error {
+	for i, level := range levels {
+		log.Printf("sync level %d: %s", i, tableNames(level))
+		if err := syncLevel(ctx, src, dst, level, opts); err != nil {
+			return err
+		}
+	}
+	//Segunda fase: completar las claves foráneas diferidas ahora que existen todas las filas
+	if opts != nil && len(opts.deferred) > 0 {
+		if err := backfillLevels(ctx, src, dst, levels, opts); err != nil {
+			return err
+		}
+	}
+	//Borrar las filas que ya no existen en el origen, las tablas hijas primero
+	if opts != nil && opts.Mirror {
+		if err := mirrorLevels(ctx, src, dst, levels, opts); err != nil {
+			return err
 		}
-		queue = queue[1:]
 	}
 	return nil
 }
@@ -115,124 +211,451 @@ func CheckConstraints(table *pgutil.TableInfo, tablesMap map[string]*pgutil.Tabl
 	return nil
 }
 
-func SyncTable(src, dst *sql.DB, table *pgutil.TableInfo) error {
-	const batchSize = 1000 // Número de filas por lote
-	var offset int = 0     // Inicialización del offset para la consulta
-	totalRows := 0         // Variable para realizar seguimiento de las filas copiadas
+// Copia las filas de la tabla de src a dst, insertando las nuevas y actualizando las existentes
+func SyncTable(src, dst *sql.DB, table *pgutil.TableInfo, opts *Options) error {
+	return SyncTableContext(context.Background(), src, dst, table, opts)
+}
+
+// Igual que SyncTable, al cancelar el contexto se detiene la copia y se descarta el lote en curso
+func SyncTableContext(ctx context.Context, src, dst *sql.DB, table *pgutil.TableInfo, opts *Options) error {
+	target := dbDestination{DB: dst, replica: opts.replica()}
+	restore, err := suppressTriggers(ctx, target, []*pgutil.TableInfo{table}, opts)
+	if err != nil {
+		return err
+	}
+	err = syncTable(ctx, src, target, table, opts)
+	if restoreErr := restore(); err == nil {
+		err = restoreErr
+	}
+	return err
+}
+
+func syncTable(ctx context.Context, src *sql.DB, dst destination, table *pgutil.TableInfo, opts *Options) error {
+	opts, err := opts.withState()
+	if err != nil {
+		return err
+	}
+	ts, warnings, err := openTableSync(ctx, src, dst, table, opts)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		log.Printf("warning: %s", warning)
+	}
+	if err := ts.run(ctx); err != nil {
+		return err
+	}
+	// Las filas se copian con sus valores, las secuencias del destino deben avanzar hasta ellos
+	return ts.syncSequences(ctx)
+}
+
+// Estado de la copia de una tabla
+type tableSync struct {
+	src         *sql.DB
+	dst         destination
+	table       *pgutil.TableInfo
+	opts        *Options
+	keys        []string        //Columnas por las que se pagina la lectura
+	keyIndexes  []int           //Posición de las columnas de la clave en la fila
+	conditions  []string        //Condiciones SQL que deben cumplir las filas leídas del origen
+	mapping     *tableMapping   //Tabla y columnas del destino
+	transforms  []Transformer   //Transformaciones de las filas antes de escribirlas
+	conflict    *conflictPolicy //Política para las filas que ya existen en el destino
+	deferred    []int           //Posición de las columnas de las claves foráneas que se copian en NULL en la primera fase
+	backfilling bool            //Segunda fase: los lotes solo completan las claves foráneas diferidas
+	totalRows   int64           //Filas copiadas, se actualiza de forma atómica
+	plan        *tablePlanner   //Si no es nil los lotes solo se comparan con el destino, sin escribir
+}
+
+// Igual que newTableSync, con las columnas de la tabla del destino ya emparejadas por nombre con las del origen
+// y las consultas de las dos tablas ya construidas. Retorna los avisos de las diferencias entre las dos tablas
+func openTableSync(ctx context.Context, src *sql.DB, dst destination, table *pgutil.TableInfo, opts *Options) (*tableSync, []string, error) {
+	ts, err := newTableSync(src, dst, table, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	warnings, err := ts.matchDestination(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Los rangos y los lotes usan las consultas de las tablas desde varias goroutines
+	ts.table.CacheQueries()
+	ts.mapping.target.CacheQueries()
+	return ts, warnings, nil
+}
+
+func newTableSync(src *sql.DB, dst destination, table *pgutil.TableInfo, opts *Options) (*tableSync, error) {
+	if opts != nil && opts.Bulk && len(table.PrimaryKey()) == 0 {
+		return nil, fmt.Errorf("bulk sync of table %s requires a primary key", table.TableName())
+	}
+	if opts != nil && opts.Upsert && len(table.PrimaryKey()) == 0 {
+		return nil, fmt.Errorf("upsert sync of table %s requires a primary key", table.TableName())
+	}
+	keys, err := opts.keyColumns(table)
+	if err != nil {
+		return nil, err
+	}
+	if watermark := opts.table(table).Watermark; watermark != "" {
+		if table.GetColumn(watermark) == nil {
+			return nil, fmt.Errorf("watermark column %s not found in table %s", watermark, table.TableName())
+		}
+		if opts.state() == nil {
+			return nil, fmt.Errorf("incremental sync of table %s requires a state file to keep its watermark", table.TableName())
+		}
+	}
+	mapping, err := opts.mapping(table, keys)
+	if err != nil {
+		return nil, err
+	}
+	transforms, err := opts.transformers(table)
+	if err != nil {
+		return nil, err
+	}
+	conflict, err := opts.conflictPolicy(table, mapping)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := opts.sequences(); err != nil {
+		return nil, err
+	}
+	ts := &tableSync{
+		src:        src,
+		dst:        dst,
+		table:      table,
+		opts:       opts,
+		keys:       keys,
+		keyIndexes: columnIndexes(table.ColumnNames(), keys),
+		mapping:    mapping,
+		transforms: transforms,
+		conflict:   conflict,
+	}
+	if opts != nil {
+		ts.deferred = columnIndexes(table.ColumnNames(), opts.deferred[table.TableName()])
+	}
+	// Copiar solo el subconjunto de filas que cumple el filtro de la tabla
+	if where := opts.table(table).Where; where != "" {
+		ts.conditions = append(ts.conditions, where)
+	}
+	return ts, nil
+}
+
+func (ts *tableSync) run(ctx context.Context) error {
+	table := ts.table
+	state := ts.opts.state()
+	saved := ts.progressState()
+
+	// Al reanudar se omite la tabla si ya se copió, o se continúa desde su avance guardado
+	var progress TableProgress
+	resumed := false
+	if state != nil && ts.opts.Resume {
+		progress, resumed = state.TableProgress(table.TableName())
+		if resumed && progress.Completed {
+			if ts.plan != nil {
+				ts.plan.plan.Skipped = true
+			}
+			fmt.Printf("Table %s.%s already completed, skipping\n", table.Scheme, table.Name)
+			return nil
+		}
+	}
+
+	// Leer del origen, desde la instantánea de las opciones si la tiene
+	reader, closeReader, err := openReader(ctx, ts.src, ts.opts)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	// Copia incremental: leer solo las filas que cambiaron desde la marca de agua de la última copia
+	// hasta el mayor valor actual, que será la nueva marca de agua si la copia termina bien
+	watermarkColumn := ts.opts.table(table).Watermark
+	var highWatermark sql.NullString
+	if watermarkColumn != "" {
+		if resumed && progress.HighWatermark != "" {
+			highWatermark = sql.NullString{String: progress.HighWatermark, Valid: true}
+		} else if err := reader.QueryRowContext(ctx, table.MaxQuery(watermarkColumn)).Scan(&highWatermark); err != nil {
+			return fmt.Errorf("error fetching watermark of %s: %w", table.TableName(), err)
+		}
+		lastWatermark, incremental := state.Watermark(table.TableName())
+		if !highWatermark.Valid && incremental {
+			ts.opts.recordRead(table.TableName(), phaseOneRead{empty: true})
+			fmt.Printf("No rows to process in table %s.%s\n", table.Scheme, table.Name)
+			return nil
+		}
+		if incremental {
+			fmt.Printf("Incremental sync of table %s.%s from %s = %s\n", table.Scheme, table.Name, watermarkColumn, lastWatermark)
+		}
+		ts.conditions = append(ts.conditions, watermarkConditions(watermarkColumn, lastWatermark, incremental, highWatermark)...)
+	}
+
+	if ts.opts != nil && ts.opts.Rows != nil {
+		// Subconjunto: copiar solo las filas con las claves calculadas
+		err = ts.syncKeys(ctx, reader, ts.opts.Rows[table.TableName()])
+	} else {
+		err = ts.syncAll(ctx, reader, progress, resumed, highWatermark.String)
+	}
+	if err != nil {
+		return err
+	}
+	ts.opts.recordRead(table.TableName(), phaseOneRead{conditions: append([]string{}, ts.conditions...)})
+
+	if saved != nil {
+		// Un subconjunto no copia todas las filas hasta la marca de agua, la próxima copia incremental debe incluirlas
+		if watermarkColumn != "" && highWatermark.Valid && ts.opts.Rows == nil {
+			if err := saved.SetWatermark(table.TableName(), highWatermark.String); err != nil {
+				return err
+			}
+		}
+		if err := saved.CompleteTable(table.TableName()); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Completed processing table %s.%s\n", table.Scheme, table.Name)
+	return nil
+}
+
+// Retorna las condiciones de la copia de las filas con la marca de agua en la columna hasta high: mayor que la última
+// marca de agua en una copia incremental, y en la primera copia también las filas con la columna en NULL, que las
+// copias incrementales ya no leen. Si high no es válido todas las filas tienen la columna en NULL
+func watermarkConditions(watermarkColumn, lastWatermark string, incremental bool, high sql.NullString) []string {
+	column := database.QuoteIdent(watermarkColumn)
+	switch {
+	case incremental:
+		return []string{
+			fmt.Sprintf("%s > %s", column, pq.QuoteLiteral(lastWatermark)),
+			fmt.Sprintf("%s <= %s", column, pq.QuoteLiteral(high.String)),
+		}
+	case !high.Valid:
+		return []string{fmt.Sprintf("%s IS NULL", column)}
+	}
+	return []string{fmt.Sprintf("(%s <= %s OR %s IS NULL)", column, pq.QuoteLiteral(high.String), column)}
+}
+
+// Copia todas las filas de la tabla que cumplen las condiciones, por rangos de claves si se pidió dividirla,
+// continuando desde el avance guardado si se reanuda
+func (ts *tableSync) syncAll(ctx context.Context, reader reader, progress TableProgress, resumed bool, highWatermark string) error {
+	table := ts.table
 
 	// Obtener el número total de filas en la tabla fuente
 	var rowCount int
-	err := src.QueryRow(table.CountQuery()).Scan(&rowCount)
+	err := reader.QueryRowContext(ctx, table.CountWhereQuery(ts.conditions...)).Scan(&rowCount)
 	if err != nil {
 		return fmt.Errorf("error fetching row count: %w", err)
 	}
 
 	fmt.Printf("Total rows to process in table %s.%s: %d\n", table.Scheme, table.Name, rowCount)
 
-	// Copiar datos por partes
-	for offset < rowCount {
+	// Rangos de claves a copiar: los guardados al reanudar, o la tabla completa dividida en partes si se pidió
+	ranges := []keyRange{{}}
+	if resumed && len(progress.Ranges) > 0 {
+		ranges = resumeRanges(progress.Ranges)
+		fmt.Printf("Resuming table %s.%s from its last committed batch\n", table.Scheme, table.Name)
+	} else {
+		if chunks := ts.opts.table(table).Chunks; chunks > 1 {
+			if ranges, err = splitKeyRanges(ctx, reader, table, ts.keys, chunks); err != nil {
+				return err
+			}
+		}
+		if saved := ts.progressState(); saved != nil {
+			if err := saved.StartTable(table.TableName(), highWatermark, ranges); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(ranges) > 1 {
+		// Copiar los rangos a la vez
+		return ts.syncRanges(ctx, ranges)
+	}
+	return ts.syncRange(ctx, reader, 0, ranges[0], "")
+}
+
+// Copia las filas del rango por lotes, cada lote comienza después de la clave de la última fila del lote anterior.
+// Si hay estado se guarda la clave de la última fila de cada lote confirmado para poder reanudar
+func (ts *tableSync) syncRange(ctx context.Context, reader reader, index int, r keyRange, label string) error {
+	if r.done {
+		return nil
+	}
+	// En modo COPY el rango se lee con una sola consulta COPY ... TO STDOUT
+	if ts.copyOut() {
+		return ts.copyRange(ctx, index, r, label)
+	}
+	table := ts.table
+	batchSize := ts.opts.batchSize() // Número de filas por lote
+	rangeRows := 0                   // Filas copiadas del rango
+
+	lastKey := r.lastKey
+	for {
 		// Obtener el siguiente lote de datos desde la base de datos fuente
-		rows, err := src.Query(table.SelectWithBatchQuery(batchSize, offset))
+		query := table.SelectKeyRangeQuery(ts.keys, batchSize, lastKey != nil, r.from != nil, r.to != nil, ts.conditions...)
+		args := r.args(lastKey)
+		rows, err := reader.QueryContext(ctx, query, args...)
 		if err != nil {
 			return fmt.Errorf("error fetching rows: %w", err)
 		}
-		defer rows.Close()
-
-		// Preparar inserciones y actualizaciones en la base de datos destino
-		insertQuery := table.InsertQuery()
-		updateQuery := table.UpdateQuery()
-		tx, err := dst.Begin() // Inicia una transacción para mejorar el rendimiento
+		batch, err := readBatch(rows, len(table.Columns), batchSize)
+		rows.Close()
 		if err != nil {
-			return fmt.Errorf("error beginning transaction: %w", err)
+			return err
 		}
-
-		insertStmt, err := tx.Prepare(insertQuery)
-		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("error preparing insert statement: %w", err)
+		if len(batch) == 0 {
+			break
+		}
+		lastKey = pickValues(batch[len(batch)-1], ts.keyIndexes)
+		rangeRows += len(batch)
+		if err := ts.writeRangeBatch(ctx, index, batch, rangeRows, label); err != nil {
+			return err
 		}
-		defer insertStmt.Close()
+		if len(batch) < batchSize {
+			break
+		}
+	}
+	if state := ts.progressState(); state != nil {
+		return state.FinishRange(table.TableName(), index)
+	}
+	return nil
+}
 
-		updateStmt, err := tx.Prepare(updateQuery)
-		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("error preparing update statement: %w", err)
+// Escribe un lote del rango, muestra el avance y, si hay estado, guarda la clave de su última fila para poder reanudar.
+// rangeRows son las filas leídas del rango contando las del lote
+func (ts *tableSync) writeRangeBatch(ctx context.Context, index int, batch [][]interface{}, rangeRows int, label string) error {
+	table := ts.table
+	lastKey := pickValues(batch[len(batch)-1], ts.keyIndexes)
+	if err := ts.write(ctx, batch); err != nil {
+		return err
+	}
+	totalRows := atomic.AddInt64(&ts.totalRows, int64(len(batch)))
+
+	if label == "" {
+		fmt.Printf("Processed %d rows from %s.%s\n", totalRows, table.Scheme, table.Name)
+	} else {
+		fmt.Printf("Processed %d rows from %s.%s %s, %d rows in table\n", rangeRows, table.Scheme, table.Name, label, totalRows)
+	}
+
+	if state := ts.progressState(); state != nil {
+		return state.SaveLastKey(table.TableName(), index, lastKey)
+	}
+	return nil
+}
+
+// Retorna el estado donde se guarda el avance de la copia, un plan o la segunda fase no guardan nada
+func (ts *tableSync) progressState() *State {
+	if ts.plan != nil || ts.backfilling {
+		return nil
+	}
+	return ts.opts.state()
+}
+
+// Transforma el lote, aplica la política de conflictos y lo escribe en el destino según el modo de las opciones
+func (ts *tableSync) write(ctx context.Context, batch [][]interface{}) error {
+	batch, err := transformBatch(ts.table, ts.transforms, batch)
+	if err != nil {
+		return err
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	if ts.plan != nil {
+		return ts.planBatch(ctx, batch)
+	}
+	if ts.backfilling {
+		return ts.backfillBatch(ctx, ts.mapping.project(batch))
+	}
+	// Primera fase: las claves foráneas diferidas se completan al final
+	for _, values := range batch {
+		for _, index := range ts.deferred {
+			values[index] = nil
 		}
-		defer updateStmt.Close()
+	}
+	target := ts.mapping.target
+	if batch, err = ts.resolveConflicts(ctx, ts.mapping.project(batch)); err != nil || len(batch) == 0 {
+		return err
+	}
+	// En la transacción única las claves foráneas se validan al confirmar, no hace falta buscarlas
+	nullMissing := ts.opts == nil || !ts.opts.SingleTransaction
+	if ts.opts != nil && ts.opts.Bulk {
+		return copyBatch(ctx, ts.dst, target, batch, nullMissing)
+	}
+	if ts.opts != nil && ts.opts.Upsert {
+		return upsertBatch(ctx, ts.dst, target, batch, nullMissing)
+	}
+	return writeBatch(ctx, ts.dst, target, batch, nullMissing)
+}
 
-		// Copiar filas al destino
-		for rows.Next() {
-			// Lee cada fila y los valores de las columnas
-			columns, err := rows.Columns()
-			if err != nil {
-				tx.Rollback()
-				return fmt.Errorf("error fetching columns: %w", err)
-			}
+// Inserta o actualiza en el destino las filas del lote dentro de una transacción.
+// Si nullMissing es true las claves foráneas sin fila referenciada en el destino se ponen en NULL
+func writeBatch(ctx context.Context, dst destination, table *pgutil.TableInfo, batch [][]interface{}, nullMissing bool) error {
+	// Preparar inserciones y actualizaciones en la base de datos destino
+	insertQuery := table.InsertQuery()
+	updateQuery := table.UpdateQuery()
+	tx, err := dst.begin(ctx) // Inicia una transacción para mejorar el rendimiento
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
 
-			values := make([]interface{}, len(columns))
-			valuePtrs := make([]interface{}, len(columns))
-			for i := range values {
-				valuePtrs[i] = &values[i]
-			}
+	insertStmt, err := tx.PrepareContext(ctx, insertQuery)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error preparing insert statement: %w", err)
+	}
+	defer insertStmt.Close()
 
-			if err := rows.Scan(valuePtrs...); err != nil {
-				tx.Rollback()
-				return fmt.Errorf("error scanning row: %w", err)
-			}
+	updateStmt, err := tx.PrepareContext(ctx, updateQuery)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error preparing update statement: %w", err)
+	}
+	defer updateStmt.Close()
 
-			// Verificar las claves foráneas y actualizar valores inexistentes a NULL
-			for _, fk := range table.Constraints {
-				refExists := checkFKExists(dst, fk.ReferencedTable, fk.Referenced, values[findColumnIndex(columns, fk.Local)])
-				if !refExists {
-					values[findColumnIndex(columns, fk.Local)] = nil // Establecer a NULL si no existe
-				}
-			}
+	// Verificar si el registro ya existe en la base de datos destino, dentro de la transacción para ver las filas del lote
+	existsStmt, err := tx.PrepareContext(ctx, table.SelectExistsQuery())
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error preparing exists statement: %w", err)
+	}
+	defer existsStmt.Close()
 
-			// Verificar si el registro ya existe en la base de datos destino
-			existsQuery := table.SelectExistsQuery()
-			existsStmt, err := dst.Prepare(existsQuery)
-			if err != nil {
-				tx.Rollback()
-				return fmt.Errorf("error preparing exists statement: %w", err)
-			}
-			defer existsStmt.Close()
+	columns := table.ColumnNames()
 
-			existsValues := getPrimaryKeyValues(table.Columns, values) // Extraer valores de claves primarias
-			var exists bool
-			if err := existsStmt.QueryRow(existsValues...).Scan(&exists); err != nil {
-				tx.Rollback()
-				return fmt.Errorf("error checking record existence: %w", err)
+	// Copiar filas al destino
+	for _, values := range batch {
+		// Verificar las claves foráneas y actualizar valores inexistentes a NULL
+		for _, fk := range table.Constraints {
+			if !nullMissing {
+				break
 			}
-
-			// Si existe, actualiza; de lo contrario, inserta
-			if exists {
-				updateValues := append(values, existsValues...) // Combinar valores para la cláusula WHERE
-				if _, err := updateStmt.Exec(updateValues...); err != nil {
-					tx.Rollback()
-					return fmt.Errorf("error updating record: %w", err)
-				}
-			} else {
-				if _, err := insertStmt.Exec(values...); err != nil {
-					tx.Rollback()
-					return fmt.Errorf("error inserting record: %w", err)
-				}
+			refExists := checkFKExists(ctx, dst, fk.ReferencedTable, fk.Referenced, values[findColumnIndex(columns, fk.Local)])
+			if !refExists {
+				values[findColumnIndex(columns, fk.Local)] = nil // Establecer a NULL si no existe
 			}
-
-			totalRows++
 		}
 
-		// Confirma la transacción
-		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("error committing transaction: %w", err)
+		existsValues := getPrimaryKeyValues(table.Columns, values) // Extraer valores de claves primarias
+		var exists bool
+		if err := existsStmt.QueryRowContext(ctx, existsValues...).Scan(&exists); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error checking record existence: %w", err)
 		}
 
-		fmt.Printf("Processed %d rows from %s.%s\n", totalRows, table.Scheme, table.Name)
-
-		// Incrementa el offset para procesar el siguiente lote
-		offset += batchSize
+		// Si existe, actualiza; de lo contrario, inserta
+		if exists {
+			updateValues := append(values, existsValues...) // Combinar valores para la cláusula WHERE
+			if _, err := updateStmt.ExecContext(ctx, updateValues...); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("error updating record: %w", err)
+			}
+		} else {
+			if _, err := insertStmt.ExecContext(ctx, values...); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("error inserting record: %w", err)
+			}
+		}
 	}
 
-	fmt.Printf("Completed processing table %s.%s\n", table.Scheme, table.Name)
+	// Confirma la transacción
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
 	return nil
 }
 
@@ -248,10 +671,10 @@ func getPrimaryKeyValues(columns []pgutil.ColumnInfo, values []interface{}) []in
 }
 
 // Verifica si una clave foránea existe en la base de datos de destino
-func checkFKExists(db *sql.DB, referencedTable string, referencedColumn string, value interface{}) bool {
-	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE %s = $1)", referencedTable, referencedColumn)
+func checkFKExists(ctx context.Context, db reader, referencedTable string, referencedColumn string, value interface{}) bool {
+	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE %s = $1)", database.QuoteTable(referencedTable), database.QuoteIdent(referencedColumn))
 	var exists bool
-	err := db.QueryRow(query, value).Scan(&exists)
+	err := db.QueryRowContext(ctx, query, value).Scan(&exists)
 	if err != nil {
 		fmt.Printf("Error checking foreign key existence: %v\n", err)
 		return false
@@ -259,6 +682,32 @@ func checkFKExists(db *sql.DB, referencedTable string, referencedColumn string,
 	return exists
 }
 
+// Retorna la posición de cada columna en el arreglo de columnas
+func columnIndexes(columns []string, names []string) []int {
+	indexes := make([]int, len(names))
+	for i, name := range names {
+		indexes[i] = findColumnIndex(columns, name)
+	}
+	return indexes
+}
+
+// Máximo de parametros de una consulta en postgres
+const maxQueryParams = 65535
+
+// Retorna cuántas claves de size columnas caben como parametros en una consulta, sin pasar de limit
+func keysPerQuery(size, limit int) int {
+	return max(1, min(limit, maxQueryParams/size))
+}
+
+// Retorna los valores de la fila en las posiciones dadas
+func pickValues(values []interface{}, indexes []int) []interface{} {
+	picked := make([]interface{}, len(indexes))
+	for i, index := range indexes {
+		picked[i] = values[index]
+	}
+	return picked
+}
+
 // Encuentra el índice de una columna en el arreglo de columnas
 func findColumnIndex(columns []string, columnName string) int {
 	for i, col := range columns {
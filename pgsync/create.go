@@ -0,0 +1,132 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Crea en el destino las tablas del destino que faltan de las tablas dadas, con su esquema, clave primaria e
+// índices, en el orden de los niveles. Las claves foráneas de las tablas creadas se agregan al final, cuando
+// existen todas las tablas, así no importan los ciclos. Las tablas que ya existen no cambian
+func createMissingTables(ctx context.Context, dst *sql.DB, levels [][]*pgutil.TableInfo, opts *Options) error {
+	created := []*pgutil.TableInfo{}
+	for _, level := range levels {
+		for _, table := range level {
+			m, err := opts.mapping(table, nil)
+			if err != nil {
+				return err
+			}
+			target := m.target
+			exists, err := tableExists(ctx, dst, target.TableName())
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if err := createTable(ctx, dst, table, target, opts); err != nil {
+				return err
+			}
+			log.Printf("created table %s", target.TableName())
+			created = append(created, target)
+		}
+	}
+	for _, target := range created {
+		for _, fk := range target.Constraints {
+			exists, err := tableExists(ctx, dst, fk.ReferencedTable)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				log.Printf("warning: foreign key %s of %s not created, table %s does not exist", fk.Name, target.TableName(), fk.ReferencedTable)
+				continue
+			}
+			if _, err := dst.ExecContext(ctx, target.AddForeignKeyQuery(fk)); err != nil {
+				return fmt.Errorf("error creating foreign key %s of %s: %w", fk.Name, target.TableName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Crea el esquema, la tabla del destino y los índices de la tabla del origen que no son la clave primaria
+func createTable(ctx context.Context, dst *sql.DB, table, target *pgutil.TableInfo, opts *Options) error {
+	createQuery, err := target.CreateTableQuery()
+	if err != nil {
+		return err
+	}
+	// Los catálogos JSON anteriores no tienen el tipo completo de las columnas
+	for _, column := range target.Columns {
+		if column.Type == "" {
+			log.Printf("warning: catalog has no exact column types for %s, type modifiers such as numeric precision are lost", target.TableName())
+			break
+		}
+	}
+	if _, err := dst.ExecContext(ctx, target.CreateSchemaQuery()); err != nil {
+		return fmt.Errorf("error creating schema %s: %w", target.Scheme, err)
+	}
+	if _, err := dst.ExecContext(ctx, createQuery); err != nil {
+		return fmt.Errorf("error creating table %s: %w", target.TableName(), err)
+	}
+	for _, index := range table.Indexes {
+		if index.IsPrimary {
+			continue
+		}
+		query, ok := indexQuery(table, target, index, opts)
+		if !ok {
+			log.Printf("warning: index %s of %s not created, it uses columns that are not copied", index.Name, target.TableName())
+			continue
+		}
+		if _, err := dst.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("error creating index %s of %s: %w", index.Name, target.TableName(), err)
+		}
+	}
+	return nil
+}
+
+// Retorna la query que crea el índice en la tabla del destino. Si la tabla del destino tiene los mismos nombres
+// que la del origen se usa la definición del índice, si no se crea sobre las columnas con sus nombres en el destino.
+// Retorna false si el índice usa una columna que no se copia
+func indexQuery(table, target *pgutil.TableInfo, index pgutil.IndexInfo, opts *Options) (string, bool) {
+	if index.Definition != "" && sameNames(table, target) {
+		return index.CreateQuery(), true
+	}
+	columns := []string{}
+	for _, column := range index.Columns {
+		name, ok := opts.targetColumn(table.TableName(), column)
+		if !ok {
+			return "", false
+		}
+		columns = append(columns, name)
+	}
+	if len(columns) == 0 {
+		return "", false
+	}
+	return target.CreateIndexQuery(index, columns), true
+}
+
+// Retorna true si la tabla del destino tiene el mismo nombre y las mismas columnas que la tabla del origen
+func sameNames(table, target *pgutil.TableInfo) bool {
+	if table.TableName() != target.TableName() || len(table.Columns) != len(target.Columns) {
+		return false
+	}
+	for i, column := range table.Columns {
+		if column.Name != target.Columns[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// Retorna true si la tabla de la forma scheme.table existe en la base de datos
+func tableExists(ctx context.Context, db reader, tableName string) (bool, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", splitTableName(tableName).QuotedName()).Scan(&exists); err != nil {
+		return false, fmt.Errorf("error checking table %s in destination: %w", tableName, err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,104 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// destination es el destino de las escrituras: la base de datos, donde cada lote abre su propia transacción,
+// o la transacción única del modo SingleTransaction, que comparten todos los lotes
+type destination interface {
+	reader
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	// Inicia la transacción de un lote
+	begin(ctx context.Context) (transaction, error)
+}
+
+// transaction es la parte de *sql.Tx que usan las escrituras de un lote
+type transaction interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	Commit() error
+	Rollback() error
+}
+
+// Destino donde cada lote se escribe en su propia transacción
+type dbDestination struct {
+	*sql.DB
+	replica bool //Las transacciones de los lotes no disparan triggers ni reglas, ver TRIGGERS_REPLICA
+}
+
+func (d dbDestination) begin(ctx context.Context) (transaction, error) {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !d.replica {
+		return tx, nil
+	}
+	if err := setReplicaRole(ctx, tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Destino donde todos los lotes se escriben en la misma transacción, que se confirma al final de la sincronización
+type txDestination struct {
+	*sql.Tx
+}
+
+func (d txDestination) begin(ctx context.Context) (transaction, error) {
+	return sharedTx{d.Tx}, nil
+}
+
+// Transacción de un lote dentro de la transacción única: confirmar o deshacer el lote no hace nada,
+// un error en cualquier lote deshace toda la sincronización
+type sharedTx struct {
+	*sql.Tx
+}
+
+func (sharedTx) Commit() error {
+	return nil
+}
+
+func (sharedTx) Rollback() error {
+	return nil
+}
+
+// Inicia la transacción única del destino con las restricciones diferibles diferidas hasta la confirmación
+func beginSingleTransaction(ctx context.Context, dst *sql.DB, opts *Options) (*sql.Tx, error) {
+	tx, err := dst.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "SET CONSTRAINTS ALL DEFERRED"); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("error deferring constraints: %w", err)
+	}
+	if opts.replica() {
+		if err := setReplicaRole(ctx, tx); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// Confirma la transacción única, si falla una restricción diferida el error indica cuál y en qué tabla
+func commitSingleTransaction(tx *sql.Tx) error {
+	err := tx.Commit()
+	if err == nil {
+		return nil
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Constraint != "" {
+		return fmt.Errorf("constraint %s on table %s failed at commit: %s: %s", pqErr.Constraint, pqErr.Table, pqErr.Message, pqErr.Detail)
+	}
+	return fmt.Errorf("error committing transaction: %w", err)
+}
@@ -0,0 +1,154 @@
+package pgsync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Columna de una tabla del destino
+type destinationColumn struct {
+	pgutil.ColumnInfo
+	hasDefault bool //Tiene valor por defecto o es identity, puede omitirse al insertar
+}
+
+// Retorna las columnas de la tabla de la base de datos en su orden, ninguna si la tabla no existe
+func destinationColumns(ctx context.Context, db reader, table *pgutil.TableInfo) ([]destinationColumn, error) {
+	query := `SELECT column_name, data_type, COALESCE(character_maximum_length, 0), is_nullable = 'YES',
+column_default IS NOT NULL OR is_identity = 'YES'
+FROM information_schema.columns
+WHERE table_schema = $1 AND table_name = $2
+ORDER BY ordinal_position`
+	rows, err := db.QueryContext(ctx, query, table.Scheme, table.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching columns of %s in destination: %w", table.TableName(), err)
+	}
+	defer rows.Close()
+	columns := []destinationColumn{}
+	for rows.Next() {
+		var column destinationColumn
+		if err := rows.Scan(&column.Name, &column.DataType, &column.LengthPrecision, &column.IsNullable, &column.hasDefault); err != nil {
+			return nil, fmt.Errorf("error scanning columns: %w", err)
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error fetching columns of %s in destination: %w", table.TableName(), err)
+	}
+	return columns, nil
+}
+
+// Tipos a los que se puede copiar una columna sin perder valores, además del mismo tipo
+var widerTypes = map[string][]string{
+	"smallint":                    {"integer", "bigint", "numeric"},
+	"integer":                     {"bigint", "numeric"},
+	"bigint":                      {"numeric"},
+	"real":                        {"double precision"},
+	"character":                   {"character varying", "text"},
+	"character varying":           {"text"},
+	"date":                        {"timestamp without time zone", "timestamp with time zone"},
+	"timestamp without time zone": {"timestamp with time zone"},
+	"json":                        {"jsonb"},
+}
+
+// Retorna true si los valores de la columna del origen caben en la columna del destino
+func compatibleType(source, destination pgutil.ColumnInfo) bool {
+	if source.DataType == destination.DataType {
+		return destination.LengthPrecision == 0 || source.LengthPrecision > 0 && source.LengthPrecision <= destination.LengthPrecision
+	}
+	for _, wider := range widerTypes[source.DataType] {
+		if wider == destination.DataType {
+			return wider == "text" || destination.LengthPrecision == 0 || source.LengthPrecision > 0 && source.LengthPrecision <= destination.LengthPrecision
+		}
+	}
+	return false
+}
+
+// Retorna true si la columna del origen cambia de tipo con una transformación cast de las opciones de la tabla
+// o con un CastTransformer registrado para la tabla o para todas las tablas
+func (opts *Options) hasCast(table *pgutil.TableInfo, column string) bool {
+	for _, to := range opts.table(table).Transforms {
+		if to.Column == column && to.Kind == "cast" {
+			return true
+		}
+	}
+	if opts == nil {
+		return false
+	}
+	registered := append(append([]Transformer{}, opts.Transformers[AllTables]...), opts.Transformers[table.TableName()]...)
+	for _, transformer := range registered {
+		caster, ok := transformer.(CastTransformer)
+		if !ok {
+			continue
+		}
+		if findColumnIndex(caster.CastColumns(), column) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Ajusta la correspondencia de la tabla a las columnas que existen en la tabla del destino, por nombre.
+// Las columnas que faltan en el destino no se copian, salvo las de las claves que son un error, y un cambio
+// de tipo que puede perder valores es un error si la columna no tiene una transformación cast en las opciones.
+// Retorna los avisos de las diferencias, si la tabla no existe en el destino no cambia nada
+func (ts *tableSync) matchDestination(ctx context.Context) ([]string, error) {
+	m := ts.mapping
+	target := m.target
+	columns, err := destinationColumns(ctx, ts.dst, target)
+	if err != nil || len(columns) == 0 {
+		return nil, err
+	}
+	byName := map[string]destinationColumn{}
+	for _, column := range columns {
+		byName[column.Name] = column
+	}
+	warnings := []string{}
+	matched := &pgutil.TableInfo{Scheme: target.Scheme, Name: target.Name}
+	indexes := []int{}
+	copied := map[string]bool{}
+	for i, column := range target.Columns {
+		source := ts.table.Columns[m.indexes[i]]
+		dstColumn, ok := byName[column.Name]
+		if !ok {
+			if column.IsPrimaryKey || findColumnIndex(m.keys, column.Name) >= 0 {
+				return nil, fmt.Errorf("key column %s of %s does not exist in destination", column.Name, target.TableName())
+			}
+			warnings = append(warnings, fmt.Sprintf("column %s of %s does not exist in destination, it is not copied", column.Name, target.TableName()))
+			continue
+		}
+		if !compatibleType(source, dstColumn.ColumnInfo) && !ts.opts.hasCast(ts.table, source.Name) {
+			return nil, fmt.Errorf("column %s of %s is %s in source and %s in destination, configure a cast transform to copy it", column.Name, target.TableName(), source.TypeName(), dstColumn.TypeName())
+		}
+		// Los valores se escriben con el tipo del destino
+		column.DataType = dstColumn.DataType
+		column.LengthPrecision = dstColumn.LengthPrecision
+		matched.Columns = append(matched.Columns, column)
+		indexes = append(indexes, m.indexes[i])
+		copied[column.Name] = true
+	}
+	for _, column := range columns {
+		if copied[column.Name] {
+			continue
+		}
+		if !column.IsNullable && !column.hasDefault {
+			return nil, fmt.Errorf("column %s of %s is not null in destination and has no value in source", column.Name, target.TableName())
+		}
+		warnings = append(warnings, fmt.Sprintf("column %s of %s only exists in destination, it keeps its default value", column.Name, target.TableName()))
+	}
+	// Las claves foráneas de columnas que no se copian no se verifican
+	for _, fk := range target.Constraints {
+		if copied[fk.Local] {
+			matched.Constraints = append(matched.Constraints, fk)
+		}
+	}
+	m.target = matched
+	m.indexes = indexes
+	m.keyIndexes = columnIndexes(matched.ColumnNames(), m.keys)
+	// La posición de la columna de la política de conflictos cambia con las columnas
+	if ts.conflict, err = ts.opts.conflictPolicy(ts.table, m); err != nil {
+		return nil, err
+	}
+	return warnings, nil
+}
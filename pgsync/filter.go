@@ -0,0 +1,78 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/stellviaproject/dbmap/database"
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Retorna el filtro de la tabla como lista de condiciones, vacía si no tiene
+func (ts *tableSync) filter() []string {
+	if where := ts.opts.table(ts.table).Where; where != "" {
+		return []string{where}
+	}
+	return nil
+}
+
+// Revisa en el origen las claves foráneas hacia tablas con filtro y retorna un aviso por cada una con filas
+// que referencian filas que el filtro del padre no copia: la copia pone esas referencias en NULL, o falla
+// si la columna no acepta nulos
+func FilterWarnings(ctx context.Context, src *sql.DB, tables []*pgutil.TableInfo, opts *Options) ([]string, error) {
+	localMap := map[string]*pgutil.TableInfo{}
+	filtered := false
+	for _, table := range tables {
+		localMap[table.TableName()] = table
+		filtered = filtered || opts.table(table).Where != ""
+	}
+	warnings := []string{}
+	if !filtered {
+		return warnings, nil
+	}
+	reader, closeReader, err := openReader(ctx, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader()
+	for _, table := range tables {
+		for _, fk := range table.Constraints {
+			parent, ok := localMap[fk.ReferencedTable]
+			if !ok || opts.table(parent).Where == "" {
+				continue
+			}
+			var count int64
+			query := orphanCountQuery(table, parent, fk, opts.table(table).Where, opts.table(parent).Where)
+			if err := reader.QueryRowContext(ctx, query).Scan(&count); err != nil {
+				return nil, fmt.Errorf("error checking filtered references of %s: %w", table.TableName(), err)
+			}
+			if count == 0 {
+				continue
+			}
+			effect := "will be set to NULL"
+			if column := table.GetColumn(fk.Local); column != nil && !column.IsNullable {
+				effect = "is not null and the copy will fail"
+			}
+			warnings = append(warnings, fmt.Sprintf(
+				"%d rows of %s reference rows of %s excluded by its filter, column %s %s",
+				count, table.TableName(), parent.TableName(), fk.Local, effect,
+			))
+		}
+	}
+	return warnings, nil
+}
+
+// Retorna la query que cuenta las filas de la tabla hija, que cumplen su filtro, cuya clave foránea
+// referencia una fila del padre que no cumple el filtro del padre
+func orphanCountQuery(table, parent *pgutil.TableInfo, fk pgutil.FKConstraintInfo, where, parentWhere string) string {
+	local := database.QuoteIdent(fk.Local)
+	query := fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s AS c WHERE c.%s IS NOT NULL AND NOT EXISTS (SELECT 1 FROM %s AS p WHERE p.%s = c.%s AND (%s))",
+		table.QuotedName(), local, parent.QuotedName(), database.QuoteIdent(fk.Referenced), local, parentWhere,
+	)
+	if where != "" {
+		query += fmt.Sprintf(" AND (%s)", where)
+	}
+	return query
+}
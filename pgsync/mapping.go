@@ -0,0 +1,99 @@
+package pgsync
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Correspondencia entre una tabla del origen y la tabla del destino donde se copia
+type tableMapping struct {
+	target     *pgutil.TableInfo //Tabla del destino con las columnas que se copian, con sus nombres en el destino
+	indexes    []int             //Posición en la fila del origen de cada columna de target
+	keys       []string          //Columnas de la clave de paginación con sus nombres en el destino
+	keyIndexes []int             //Posición de las columnas de keys en las filas de target
+}
+
+// Retorna el nombre en el destino de la tabla del origen, en la forma scheme.table
+func (opts *Options) targetName(tableName string) string {
+	if opts != nil {
+		if target := opts.Tables[tableName].Target; target != "" {
+			return target
+		}
+	}
+	return tableName
+}
+
+// Retorna el nombre en el destino de la columna de la tabla del origen, y false si la columna no se copia
+func (opts *Options) targetColumn(tableName, column string) (string, bool) {
+	if opts == nil {
+		return column, true
+	}
+	target, ok := opts.Tables[tableName].Columns[column]
+	if !ok {
+		return column, true
+	}
+	return target, target != ""
+}
+
+// Construye la tabla del destino de la tabla del origen según las opciones: el nombre de la tabla, las columnas
+// que se copian con sus nombres y las claves foráneas hacia las tablas del destino. Las columnas de la clave
+// primaria y de la clave de paginación no pueden omitirse
+func (opts *Options) mapping(table *pgutil.TableInfo, keys []string) (*tableMapping, error) {
+	tableName := table.TableName()
+	target := splitTableName(opts.targetName(tableName))
+	m := &tableMapping{target: target}
+	mapped := map[string]string{}
+	for i, column := range table.Columns {
+		name, ok := opts.targetColumn(tableName, column.Name)
+		if !ok {
+			if column.IsPrimaryKey {
+				return nil, fmt.Errorf("primary key column %s of %s cannot be left out of the copy", column.Name, tableName)
+			}
+			continue
+		}
+		column.Name = name
+		target.Columns = append(target.Columns, column)
+		m.indexes = append(m.indexes, i)
+		mapped[table.Columns[i].Name] = name
+	}
+	for _, fk := range table.Constraints {
+		local, ok := mapped[fk.Local]
+		if !ok {
+			continue
+		}
+		referenced, _ := opts.targetColumn(fk.ReferencedTable, fk.Referenced)
+		fk.Local = local
+		fk.ReferencedTable = splitTableName(opts.targetName(fk.ReferencedTable)).TableName()
+		fk.Referenced = referenced
+		target.Constraints = append(target.Constraints, fk)
+	}
+	for _, key := range keys {
+		name, ok := mapped[key]
+		if !ok {
+			return nil, fmt.Errorf("key column %s of %s cannot be left out of the copy", key, tableName)
+		}
+		m.keys = append(m.keys, name)
+	}
+	m.keyIndexes = columnIndexes(target.ColumnNames(), m.keys)
+	return m, nil
+}
+
+// Retorna las filas con los valores de las columnas de la tabla del destino, en su orden
+func (m *tableMapping) project(batch [][]interface{}) [][]interface{} {
+	projected := make([][]interface{}, len(batch))
+	for i, values := range batch {
+		projected[i] = pickValues(values, m.indexes)
+	}
+	return projected
+}
+
+// Retorna una tabla sin columnas con el esquema y el nombre de la forma scheme.table, si no tiene esquema es public
+func splitTableName(tableName string) *pgutil.TableInfo {
+	scheme, name, ok := strings.Cut(tableName, ".")
+	if !ok {
+		return &pgutil.TableInfo{Scheme: "public", Name: tableName}
+	}
+	return &pgutil.TableInfo{Scheme: scheme, Name: name}
+}
@@ -0,0 +1,203 @@
+package pgsync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Estrategias de enmascaramiento de una columna
+const (
+	MASK_HASH   = "hash"   //Valor derivado del original: permutación del rango del tipo para columnas enteras, texto hexadecimal para las demás
+	MASK_NAME   = "name"   //Nombre y apellido ficticios
+	MASK_EMAIL  = "email"  //Correo ficticio en example.com
+	MASK_PHONE  = "phone"  //Mismo formato con otros dígitos
+	MASK_DATE   = "date"   //Fecha desplazada hasta Days días hacia atrás o hacia adelante
+	MASK_REDACT = "redact" //Asteriscos, dejando visibles los últimos Keep caracteres
+	MASK_NULL   = "null"   //NULL
+)
+
+// Enmascaramiento de una columna. Salvo MASK_NULL y MASK_REDACT, el valor falso se deriva del original y del
+// secreto de las opciones con HMAC-SHA256, así el mismo valor produce el mismo valor falso en todas las tablas
+// y las claves foráneas o naturales enmascaradas con la misma estrategia siguen coincidiendo
+type MaskOptions struct {
+	Strategy string `json:"strategy"`       //Una de las estrategias MASK_*
+	Days     int    `json:"days,omitempty"` //Máximo desplazamiento de MASK_DATE, 30 días por defecto
+	Keep     int    `json:"keep,omitempty"` //Caracteres visibles al final en MASK_REDACT
+}
+
+const defaultMaskDays = 30
+
+var fakeFirstNames = []string{
+	"Alejandro", "Beatriz", "Carlos", "Daniela", "Eduardo", "Fernanda", "Gabriel", "Helena", "Ignacio", "Julia",
+	"Lorenzo", "Marta", "Nicolás", "Olga", "Pablo", "Raquel", "Sergio", "Teresa", "Vicente", "Yolanda",
+}
+
+var fakeLastNames = []string{
+	"Álvarez", "Benítez", "Castro", "Domínguez", "Estévez", "Fuentes", "García", "Herrera", "Iglesias", "Jiménez",
+	"León", "Molina", "Navarro", "Ortega", "Pérez", "Quintana", "Romero", "Suárez", "Torres", "Vargas",
+}
+
+// Retorna un Transformer que enmascara la columna con la estrategia dada
+func Mask(column pgutil.ColumnInfo, mask MaskOptions, secret string) (Transformer, error) {
+	if secret == "" && mask.Strategy != MASK_NULL && mask.Strategy != MASK_REDACT {
+		return nil, fmt.Errorf("masking column %s requires a secret", column.Name)
+	}
+	// El texto recortado a pocos caracteres choca, una clave con MASK_HASH necesita al menos 64 bits
+	_, integer := integerBits[column.DataType]
+	if mask.Strategy == MASK_HASH && column.IsPrimaryKey && !integer && column.LengthPrecision > 0 && column.LengthPrecision < 16 {
+		return nil, fmt.Errorf("column %s is too short to mask a key with hash without collisions", column.Name)
+	}
+	m := &masker{secret: []byte(secret), column: column, mask: mask}
+	var fn ValueFunc
+	switch mask.Strategy {
+	case MASK_HASH:
+		fn = m.hash
+	case MASK_NAME:
+		fn = m.name
+	case MASK_EMAIL:
+		fn = m.email
+	case MASK_PHONE:
+		fn = m.phone
+	case MASK_DATE:
+		fn = m.date
+	case MASK_REDACT:
+		fn = m.redact
+	case MASK_NULL:
+		fn = func(interface{}) (interface{}, error) { return nil, nil }
+	default:
+		return nil, fmt.Errorf("unknown mask strategy %s for column %s", mask.Strategy, column.Name)
+	}
+	return Column(column.Name, func(value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		return fn(value)
+	}), nil
+}
+
+type masker struct {
+	secret []byte
+	column pgutil.ColumnInfo
+	mask   MaskOptions
+}
+
+// Retorna el HMAC del valor, la estrategia forma parte del mensaje para que cada una derive valores independientes
+func (m *masker) sum(value interface{}) []byte {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(m.mask.Strategy))
+	mac.Write([]byte{0})
+	mac.Write([]byte(valueText(value)))
+	return mac.Sum(nil)
+}
+
+// Recorta el texto a la longitud de la columna si la tiene
+func (m *masker) fit(text string) string {
+	if size := m.column.LengthPrecision; size > 0 && len([]rune(text)) > size {
+		return string([]rune(text)[:size])
+	}
+	return text
+}
+
+func (m *masker) hash(value interface{}) (interface{}, error) {
+	if bits, ok := integerBits[m.column.DataType]; ok {
+		return m.permute(value, bits)
+	}
+	return m.fit(hex.EncodeToString(m.sum(value))), nil
+}
+
+// Bits de los tipos enteros, MASK_HASH los enmascara con una permutación de todo el rango del tipo
+var integerBits = map[string]uint{"smallint": 16, "integer": 32, "bigint": 64}
+
+// Rondas de la red de Feistel de permute
+const feistelRounds = 4
+
+// Enmascara el entero con una red de Feistel sobre los bits del tipo con el HMAC como función de ronda. Es una
+// permutación del rango del tipo: valores distintos nunca dan el mismo valor falso, así las claves no chocan
+func (m *masker) permute(value interface{}, bits uint) (interface{}, error) {
+	n, ok := value.(int64)
+	if !ok {
+		parsed, err := strconv.ParseInt(strings.TrimSpace(valueText(value)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q in column %s", valueText(value), m.column.Name)
+		}
+		n = parsed
+	}
+	// Pasar del rango con signo del tipo a [0, 2^bits)
+	offset := uint64(1) << (bits - 1)
+	if bits < 64 && (n < -int64(offset) || n >= int64(offset)) {
+		return nil, fmt.Errorf("value %d out of range of %s in column %s", n, m.column.DataType, m.column.Name)
+	}
+	half := bits / 2
+	halfMask := uint64(1)<<half - 1
+	u := uint64(n) + offset
+	left, right := (u>>half)&halfMask, u&halfMask
+	for round := 0; round < feistelRounds; round++ {
+		left, right = right, left^(m.roundKey(round, right)&halfMask)
+	}
+	return int64((left<<half | right) - offset), nil
+}
+
+// Función de ronda de permute: el HMAC de la ronda y la mitad derecha
+func (m *masker) roundKey(round int, right uint64) uint64 {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(m.mask.Strategy))
+	mac.Write([]byte{0, byte(round)})
+	binary.Write(mac, binary.BigEndian, right)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (m *masker) name(value interface{}) (interface{}, error) {
+	sum := m.sum(value)
+	first := fakeFirstNames[int(sum[0])%len(fakeFirstNames)]
+	last := fakeLastNames[int(sum[1])%len(fakeLastNames)]
+	return m.fit(first + " " + last), nil
+}
+
+func (m *masker) email(value interface{}) (interface{}, error) {
+	return m.fit("user_" + hex.EncodeToString(m.sum(value)[:6]) + "@example.com"), nil
+}
+
+func (m *masker) phone(value interface{}) (interface{}, error) {
+	sum := m.sum(value)
+	digits := []rune(valueText(value))
+	for i, r := range digits {
+		if r >= '0' && r <= '9' {
+			digits[i] = rune('0' + sum[i%len(sum)]%10)
+		}
+	}
+	return string(digits), nil
+}
+
+func (m *masker) date(value interface{}) (interface{}, error) {
+	days := m.mask.Days
+	if days <= 0 {
+		days = defaultMaskDays
+	}
+	t, ok := value.(time.Time)
+	if !ok {
+		parsed, err := parseTimestamp(valueText(value))
+		if err != nil {
+			return nil, err
+		}
+		t = parsed.(time.Time)
+	}
+	shift := int(binary.BigEndian.Uint32(m.sum(value))%uint32(2*days+1)) - days
+	if shift == 0 {
+		shift = 1
+	}
+	return t.AddDate(0, 0, shift), nil
+}
+
+func (m *masker) redact(value interface{}) (interface{}, error) {
+	text := []rune(valueText(value))
+	keep := min(max(m.mask.Keep, 0), len(text))
+	return strings.Repeat("*", len(text)-keep) + string(text[len(text)-keep:]), nil
+}
@@ -0,0 +1,133 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Borra del destino las filas de las tablas cuya clave no existe en el origen. Los niveles se recorren en orden
+// inverso, así las filas hijas se borran antes que las filas que referencian
+func mirrorLevels(ctx context.Context, src *sql.DB, dst destination, levels [][]*pgutil.TableInfo, opts *Options) error {
+	for i := len(levels) - 1; i >= 0; i-- {
+		level := levels[i]
+		log.Printf("mirror level %d: %s", i, tableNames(level))
+		err := runConcurrently(ctx, opts.workers(), len(level), func(ctx context.Context, j int) error {
+			// Los avisos de las columnas ya se mostraron al copiar la tabla
+			ts, _, err := openTableSync(ctx, src, dst, level[j], opts)
+			if err != nil {
+				return err
+			}
+			return ts.mirror(ctx)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recorre las claves del destino por lotes y borra las que no existen en el origen, en un plan solo las cuenta.
+// Si la tabla tiene filtro también se borran las filas del destino que no lo cumplen en el origen
+func (ts *tableSync) mirror(ctx context.Context) error {
+	table := ts.table
+	target := ts.mapping.target
+	// Las claves enmascaradas del destino no pueden buscarse en el origen
+	for _, key := range ts.keys {
+		if _, ok := ts.opts.table(table).Mask[key]; ok {
+			return fmt.Errorf("mirror of %s cannot compare its masked key column %s", table.TableName(), key)
+		}
+	}
+	if ts.plan != nil && ts.plan.plan.NoTable {
+		return nil
+	}
+	reader, closeReader, err := openReader(ctx, ts.src, ts.opts)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	batchSize := keysPerQuery(len(ts.keys), ts.opts.batchSize())
+	var deleted int64
+	var lastKey []interface{}
+	for {
+		rows, err := ts.dst.QueryContext(ctx, target.SelectKeysQuery(ts.mapping.keys, batchSize, lastKey != nil), lastKey...)
+		if err != nil {
+			return fmt.Errorf("error fetching destination keys of %s: %w", target.TableName(), err)
+		}
+		keys, err := readBatch(rows, len(ts.keys), batchSize)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			break
+		}
+		lastKey = keys[len(keys)-1]
+
+		missing, err := missingKeys(ctx, reader, table, ts.keys, keys, ts.filter()...)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			if ts.plan != nil {
+				atomic.AddInt64(&ts.plan.plan.Delete, int64(len(missing)))
+			} else if err := deleteKeys(ctx, ts.dst, target, ts.mapping.keys, missing); err != nil {
+				return err
+			}
+			deleted += int64(len(missing))
+		}
+
+		if len(keys) < batchSize {
+			break
+		}
+	}
+	if ts.plan == nil {
+		fmt.Printf("Deleted %d rows missing in source from %s.%s\n", deleted, target.Scheme, target.Name)
+	}
+	return nil
+}
+
+// Retorna las claves de la lista que no existen en la tabla del origen entre las filas que cumplen las condiciones
+func missingKeys(ctx context.Context, reader reader, table *pgutil.TableInfo, keyColumns []string, keys [][]interface{}, conditions ...string) ([][]interface{}, error) {
+	rows, err := reader.QueryContext(ctx, table.SelectExistingKeysQuery(keyColumns, len(keys), conditions...), keyArgs(keys)...)
+	if err != nil {
+		return nil, fmt.Errorf("error checking source keys of %s: %w", table.TableName(), err)
+	}
+	existing, err := readBatch(rows, len(keyColumns), len(keys))
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, key := range existing {
+		found[rowText(key)] = true
+	}
+	missing := [][]interface{}{}
+	for _, key := range keys {
+		if !found[rowText(key)] {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
+
+// Borra del destino las filas con las claves dadas, en una transacción para que se borren sin triggers en TRIGGERS_REPLICA
+func deleteKeys(ctx context.Context, dst destination, table *pgutil.TableInfo, keyColumns []string, keys [][]interface{}) error {
+	tx, err := dst.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, table.DeleteByKeysQuery(keyColumns, len(keys)), keyArgs(keys)...); err != nil {
+		return fmt.Errorf("error deleting rows from %s: %w", table.TableName(), err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
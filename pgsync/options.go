@@ -0,0 +1,151 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+const defaultBatchSize = 1000      // Número de filas por lote
+const defaultBulkBatchSize = 50000 // Número de filas por lote en modo COPY
+
+// Opciones de la sincronización, el valor nil equivale a las opciones por defecto
+type Options struct {
+	BatchSize         int                     `json:"batchSize,omitempty"`         //Filas por lote y por transacción en el destino
+	Bulk              bool                    `json:"bulk,omitempty"`              //Leer el origen con COPY TO STDOUT y escribir con COPY FROM STDIN a una tabla temporal que se mezcla con la tabla destino, ver CopySource
+	Upsert            bool                    `json:"upsert,omitempty"`            //Escribir cada lote con INSERT ... ON CONFLICT de varias filas en lugar de consultar cada fila, Bulk tiene prioridad
+	Workers           int                     `json:"workers,omitempty"`           //Tablas de un mismo nivel de dependencias que se copian a la vez, 1 por defecto
+	Snapshot          bool                    `json:"snapshot,omitempty"`          //Leer todas las tablas del origen desde una misma instantánea
+	SnapshotID        string                  `json:"-"`                           //Instantánea exportada que importan las lecturas, ver ExportSnapshot
+	CopySource        *pgxpool.Pool           `json:"-"`                           //Conexiones pgx al origen para leer con COPY TO STDOUT en modo Bulk, lib/pq no lo permite. Sin ellas el origen se lee con SELECT
+	StateFile         string                  `json:"stateFile,omitempty"`         //Archivo donde se guarda el estado entre ejecuciones, ver State
+	Resume            bool                    `json:"resume,omitempty"`            //Continuar la sincronización interrumpida desde el avance guardado en el estado
+	Mirror            bool                    `json:"mirror,omitempty"`            //SyncTables borra del destino las filas cuya clave no existe en el origen
+	TwoPhase          bool                    `json:"twoPhase,omitempty"`          //Copiar en NULL las claves foráneas a la propia tabla o de ciclos y completarlas al final, ver deferredKeys
+	SingleTransaction bool                    `json:"singleTransaction,omitempty"` //Escribir todo en una transacción con las restricciones diferidas hasta confirmarla, los lotes se escriben de uno en uno
+	CreateTables      bool                    `json:"createTables,omitempty"`      //SyncTables crea en el destino las tablas que faltan con sus esquemas, índices y claves foráneas, ver createMissingTables
+	Triggers          string                  `json:"triggers,omitempty"`          //Cómo se suprimen los triggers del destino durante la carga, uno de TRIGGERS_*
+	Sequences         string                  `json:"sequences,omitempty"`         //Hasta dónde avanzan las secuencias del destino después de copiar cada tabla, uno de SEQUENCES_*
+	MaskSecret        string                  `json:"maskSecret,omitempty"`        //Secreto del que se derivan los valores enmascarados, ver MaskOptions
+	State             *State                  `json:"-"`                           //Estado cargado, si es nil y hay StateFile se carga de él
+	Subset            *SubsetOptions          `json:"subset,omitempty"`            //Copiar solo las filas semilla y las filas relacionadas con ellas, ver Subset
+	Rows              RowSet                  `json:"-"`                           //Subconjunto calculado, si no es nil solo se copian las filas con estas claves
+	Tables            map[string]TableOptions `json:"tables,omitempty"`            //Opciones por tabla, la clave es el nombre en la forma scheme.table
+
+	Transformers map[string][]Transformer `json:"-"` //Transformaciones registradas por tabla, la clave AllTables aplica a todas
+	Resolvers    map[string]ConflictFunc  `json:"-"` //Funciones de la política de conflictos CONFLICT_CUSTOM por tabla
+
+	deferred map[string][]string          //Columnas de las claves foráneas diferidas por tabla en la carga en dos fases
+	phaseOne *phaseOne                    //Lecturas de la primera fase de la carga en dos fases, ver backfill
+	catalog  map[string]*pgutil.TableInfo //Tablas del catálogo por nombre, para enmascarar las claves foráneas con el tipo de la columna referenciada
+}
+
+// Opciones de la sincronización de una tabla
+type TableOptions struct {
+	Key            []string               `json:"key,omitempty"`            //Columnas de un indice unico no nulo para paginar, por defecto la clave primaria
+	Chunks         int                    `json:"chunks,omitempty"`         //Partes por rangos de clave que se copian a la vez, para tablas muy grandes
+	Watermark      string                 `json:"watermark,omitempty"`      //Columna de seguimiento de cambios (ej. updated_at), solo se copian las filas con un valor mayor al de la última copia
+	Where          string                 `json:"where,omitempty"`          //Condición SQL que deben cumplir las filas del origen para copiarse (ej. province_id = 5)
+	Target         string                 `json:"target,omitempty"`         //Tabla del destino en la forma scheme.table, por defecto la misma del origen
+	Columns        map[string]string      `json:"columns,omitempty"`        //Nombre en el destino de las columnas del origen, una columna con nombre vacío no se copia
+	Transforms     []TransformOptions     `json:"transforms,omitempty"`     //Transformaciones incorporadas que se aplican a las filas, en orden
+	Mask           map[string]MaskOptions `json:"mask,omitempty"`           //Enmascaramiento por columna, se aplica después de las transformaciones
+	Conflict       string                 `json:"conflict,omitempty"`       //Política para las filas que ya existen en el destino, una de CONFLICT_*
+	ConflictColumn string                 `json:"conflictColumn,omitempty"` //Columna que se compara en CONFLICT_NEWER (ej. updated_at)
+}
+
+func (opts *Options) batchSize() int {
+	if opts != nil && opts.BatchSize > 0 {
+		return opts.BatchSize
+	}
+	if opts != nil && opts.Bulk {
+		return defaultBulkBatchSize
+	}
+	return defaultBatchSize
+}
+
+func (opts *Options) workers() int {
+	if opts != nil && opts.Workers > 1 {
+		return opts.Workers
+	}
+	return 1
+}
+
+// Retorna una copia de las opciones con el estado cargado de StateFile, o las mismas opciones si no hace falta cargarlo
+func (opts *Options) withState() (*Options, error) {
+	if opts == nil || opts.State != nil {
+		return opts, nil
+	}
+	if opts.StateFile == "" {
+		if opts.Resume {
+			return nil, fmt.Errorf("resume requires a state file")
+		}
+		return opts, nil
+	}
+	state, err := LoadState(opts.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	stateOpts := *opts
+	stateOpts.State = state
+	return &stateOpts, nil
+}
+
+// Retorna una copia de las opciones con el subconjunto de filas calculado, o las mismas opciones si no hace falta calcularlo
+func (opts *Options) withSubset(ctx context.Context, src *sql.DB, tables []*pgutil.TableInfo) (*Options, error) {
+	if opts == nil || opts.Subset == nil || opts.Rows != nil {
+		return opts, nil
+	}
+	rows, err := Subset(ctx, src, tables, opts)
+	if err != nil {
+		return nil, err
+	}
+	subsetOpts := *opts
+	subsetOpts.Rows = rows
+	return &subsetOpts, nil
+}
+
+func (opts *Options) state() *State {
+	if opts == nil {
+		return nil
+	}
+	return opts.State
+}
+
+// Retorna una copia de las opciones con las tablas del catálogo
+func (opts *Options) withCatalog(tableMap map[string]*pgutil.TableInfo) *Options {
+	catalogOpts := Options{}
+	if opts != nil {
+		catalogOpts = *opts
+	}
+	catalogOpts.catalog = tableMap
+	return &catalogOpts
+}
+
+// Retorna las opciones de la tabla, vacías si no tiene
+func (opts *Options) table(table *pgutil.TableInfo) TableOptions {
+	if opts == nil {
+		return TableOptions{}
+	}
+	return opts.Tables[table.TableName()]
+}
+
+// Retorna las columnas por las que se pagina la lectura de la tabla
+func (opts *Options) keyColumns(table *pgutil.TableInfo) ([]string, error) {
+	keys := opts.table(table).Key
+	if len(keys) == 0 {
+		keys = table.UniqueKey()
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("table %s has no primary key or unique index to paginate, set its key in the options", table.TableName())
+	}
+	for _, key := range keys {
+		if table.GetColumn(key) == nil {
+			return nil, fmt.Errorf("key column %s not found in table %s", key, table.TableName())
+		}
+	}
+	return keys, nil
+}
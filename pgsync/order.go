@@ -0,0 +1,122 @@
+package pgsync
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Agrupa las tablas en niveles de dependencia: las tablas de un nivel solo referencian tablas de niveles anteriores,
+// por lo que todas las tablas de un mismo nivel pueden copiarse a la vez. Las referencias a la propia tabla no cuentan.
+// Si hay un ciclo, se ignoran las claves foráneas que aceptan nulos de las tablas del ciclo, porque la copia
+// las pone en NULL cuando la fila referenciada aún no existe; si aun así no se puede avanzar retorna un error
+func DependencyLevels(tables []*pgutil.TableInfo) ([][]*pgutil.TableInfo, error) {
+	localMap := map[string]*pgutil.TableInfo{}
+	for _, table := range tables {
+		localMap[table.TableName()] = table
+	}
+	//Tablas de la consulta que referencia cada tabla
+	deps := map[string]map[string]bool{}
+	for _, table := range tables {
+		deps[table.TableName()] = localDependencies(table, localMap, false)
+	}
+
+	levels := [][]*pgutil.TableInfo{}
+	done := map[string]bool{}
+	pending := tables
+	relaxed := false
+	for len(pending) > 0 {
+		level := []*pgutil.TableInfo{}
+		waiting := []*pgutil.TableInfo{}
+		for _, table := range pending {
+			if dependenciesDone(deps[table.TableName()], done) {
+				level = append(level, table)
+			} else {
+				waiting = append(waiting, table)
+			}
+		}
+		if len(level) == 0 {
+			if relaxed {
+				return nil, fmt.Errorf("infinite loop detected in table dependecies: %s", tableNames(waiting))
+			}
+			//Romper los ciclos ignorando las claves foráneas que aceptan nulos de las tablas que forman parte de uno
+			for _, table := range waiting {
+				if inCycle(table.TableName(), deps) {
+					deps[table.TableName()] = localDependencies(table, localMap, true)
+				}
+			}
+			relaxed = true
+			continue
+		}
+		for _, table := range level {
+			done[table.TableName()] = true
+		}
+		levels = append(levels, level)
+		pending = waiting
+		relaxed = false
+	}
+	return levels, nil
+}
+
+// Retorna las tablas de la consulta que referencia la tabla, sin contar la propia tabla.
+// Con onlyRequired en true solo cuentan las claves foráneas que no aceptan nulos
+func localDependencies(table *pgutil.TableInfo, localMap map[string]*pgutil.TableInfo, onlyRequired bool) map[string]bool {
+	deps := map[string]bool{}
+	for _, fk := range table.Constraints {
+		if fk.ReferencedTable == table.TableName() {
+			continue
+		}
+		if _, ok := localMap[fk.ReferencedTable]; !ok {
+			continue
+		}
+		if onlyRequired {
+			if column := table.GetColumn(fk.Local); column == nil || column.IsNullable {
+				continue
+			}
+		}
+		deps[fk.ReferencedTable] = true
+	}
+	return deps
+}
+
+// Retorna true si la tabla se alcanza a sí misma siguiendo sus dependencias
+func inCycle(tableName string, deps map[string]map[string]bool) bool {
+	visited := map[string]bool{}
+	stack := []string{}
+	for dep := range deps[tableName] {
+		stack = append(stack, dep)
+	}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if current == tableName {
+			return true
+		}
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		for dep := range deps[current] {
+			stack = append(stack, dep)
+		}
+	}
+	return false
+}
+
+func dependenciesDone(deps map[string]bool, done map[string]bool) bool {
+	for dep := range deps {
+		if !done[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+func tableNames(tables []*pgutil.TableInfo) string {
+	names := []string{}
+	for _, table := range tables {
+		names = append(names, table.TableName())
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,69 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Copia las tablas de un nivel de dependencias con opts.Workers copias a la vez, cada una con sus propias
+// conexiones del pool de src y dst. El primer error cancela las copias en curso y es el error retornado
+func syncLevel(ctx context.Context, src *sql.DB, dst destination, level []*pgutil.TableInfo, opts *Options) error {
+	return runConcurrently(ctx, opts.workers(), len(level), func(ctx context.Context, i int) error {
+		table := level[i]
+		log.Printf("sync table %s.%s", table.Scheme, table.Name)
+		return syncTable(ctx, src, dst, table, opts)
+	})
+}
+
+// Ejecuta task para cada posición de 0 a count-1 con hasta workers tareas a la vez.
+// El primer error cancela el contexto de las tareas en curso y es el error retornado
+func runConcurrently(ctx context.Context, workers, count int, task func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if workers > count {
+		workers = count
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var firstErr error
+	var once sync.Once
+	var wg sync.WaitGroup
+	queue := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if err := task(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < count; i++ {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,957 @@
+package pgsync
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+const fixture = `{
+  "Tables": [
+    {
+      "Scheme": "pkt_encoders",
+      "Name": "nom_gender",
+      "Columns": [
+        {"Name": "id", "DataType": "integer", "IsPrimaryKey": true},
+        {"Name": "name", "DataType": "character varying", "LengthPrecision": 50}
+      ]
+    },
+    {
+      "Scheme": "pkt_organization",
+      "Name": "tb_student",
+      "Columns": [
+        {"Name": "id", "DataType": "integer", "IsPrimaryKey": true},
+        {"Name": "name", "DataType": "character varying", "LengthPrecision": 100},
+        {"Name": "gender_id", "DataType": "integer"}
+      ],
+      "Constraints": [
+        {"Name": "fk_student_gender", "Local": "gender_id", "Referenced": "id", "ReferencedTable": "pkt_encoders.nom_gender"}
+      ]
+    },
+    {
+      "Scheme": "pkt_organization",
+      "Name": "tb_application",
+      "Columns": [
+        {"Name": "id", "DataType": "integer", "IsPrimaryKey": true},
+        {"Name": "student_id", "DataType": "integer", "IsNullable": true}
+      ],
+      "Constraints": [
+        {"Name": "fk_application_student", "Local": "student_id", "Referenced": "id", "ReferencedTable": "pkt_organization.tb_student"}
+      ]
+    }
+  ]
+}`
+
+func testCatalog(t *testing.T) *pgutil.FixtureCatalog {
+	t.Helper()
+	catalog, err := pgutil.ParseFixtureCatalog([]byte(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return catalog
+}
+
+func testTableMap(t *testing.T) map[string]*pgutil.TableInfo {
+	t.Helper()
+	info, err := testCatalog(t).GetDataBaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableMap := map[string]*pgutil.TableInfo{}
+	for _, table := range info.Tables {
+		tableMap[table.TableName()] = table
+	}
+	return tableMap
+}
+
+func TestCheckConstraints(t *testing.T) {
+	tableMap := testTableMap(t)
+	student := tableMap["pkt_organization.tb_student"]
+	if err := CheckConstraints(student, tableMap); err != nil {
+		t.Fatal(err)
+	}
+	delete(tableMap, "pkt_encoders.nom_gender")
+	if err := CheckConstraints(student, tableMap); err == nil {
+		t.Fatal("se esperaba un error al faltar la tabla referenciada por una clave foranea no nula")
+	}
+}
+
+// Con IsNullable leído del catálogo una clave foránea que acepta nulos no obliga a copiar la tabla referenciada
+func TestNullableForeignKeys(t *testing.T) {
+	tableMap := testTableMap(t)
+	application := tableMap["pkt_organization.tb_application"]
+	student := tableMap["pkt_organization.tb_student"]
+	delete(tableMap, "pkt_organization.tb_student")
+	if err := CheckConstraints(application, tableMap); err != nil {
+		t.Errorf("la clave foranea acepta nulos, no deberia fallar: %v", err)
+	}
+	if !CanSync(application, map[string]*pgutil.TableInfo{}) {
+		t.Error("tb_application deberia poder copiarse sin tb_student")
+	}
+	if CanSync(student, map[string]*pgutil.TableInfo{}) {
+		t.Error("tb_student no deberia copiarse antes de nom_gender")
+	}
+	//Sin IsNullable la misma clave foránea exige la tabla referenciada, como antes de leerlo del catálogo
+	notNull := *application
+	notNull.Columns = []pgutil.ColumnInfo{application.Columns[0], {Name: "student_id", DataType: "integer"}}
+	if err := CheckConstraints(&notNull, tableMap); err == nil {
+		t.Error("se esperaba un error por una clave foranea no nula sin su tabla")
+	}
+}
+
+func TestGetReferences(t *testing.T) {
+	tableMap := testTableMap(t)
+	refs := GetReferences(tableMap["pkt_organization.tb_application"], tableMap)
+	if len(refs) != 1 || refs[0].Name != "tb_student" {
+		t.Fatalf("referencias inesperadas: %v", refs)
+	}
+	if refs := GetReferences(tableMap["pkt_encoders.nom_gender"], tableMap); len(refs) != 0 {
+		t.Fatalf("nom_gender no deberia tener referencias: %v", refs)
+	}
+}
+
+func TestNullMissingFKQuery(t *testing.T) {
+	tableMap := testTableMap(t)
+	student := tableMap["pkt_organization.tb_student"]
+	stage := &pgutil.TableInfo{Scheme: "pg_temp", Name: stageTable, Columns: student.Columns}
+	query := nullMissingFKQuery(stage, student, student.Constraints[0])
+	want := `UPDATE "pg_temp"."dbmap_stage" AS s SET "gender_id" = NULL WHERE s."gender_id" IS NOT NULL AND NOT EXISTS (SELECT 1 FROM "pkt_encoders"."nom_gender" AS r WHERE r."id" = s."gender_id")`
+	if query != want {
+		t.Fatalf("consulta inesperada:\n got: %s\nwant: %s", query, want)
+	}
+
+	parent := pgutil.FKConstraintInfo{Name: "fk_student_parent", Local: "parent_id", Referenced: "id", ReferencedTable: "pkt_organization.tb_student"}
+	query = nullMissingFKQuery(stage, student, parent)
+	want = `UPDATE "pg_temp"."dbmap_stage" AS s SET "parent_id" = NULL WHERE s."parent_id" IS NOT NULL AND NOT EXISTS (SELECT 1 FROM "pkt_organization"."tb_student" AS r WHERE r."id" = s."parent_id") AND NOT EXISTS (SELECT 1 FROM "pg_temp"."dbmap_stage" AS b WHERE b."id" = s."parent_id")`
+	if query != want {
+		t.Fatalf("consulta inesperada:\n got: %s\nwant: %s", query, want)
+	}
+}
+
+func TestDependencyLevels(t *testing.T) {
+	tableMap := testTableMap(t)
+	levels, err := DependencyLevels([]*pgutil.TableInfo{
+		tableMap["pkt_organization.tb_application"],
+		tableMap["pkt_organization.tb_student"],
+		tableMap["pkt_encoders.nom_gender"],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, level := range levels {
+		got = append(got, tableNames(level))
+	}
+	want := []string{"pkt_encoders.nom_gender", "pkt_organization.tb_student", "pkt_organization.tb_application"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("niveles inesperados: %v", got)
+	}
+
+	//Ciclo entre tb_student y tb_application que se rompe por la clave foránea nula de tb_application
+	student := *tableMap["pkt_organization.tb_student"]
+	student.Columns = append(student.Columns, pgutil.ColumnInfo{Name: "application_id", DataType: "integer"})
+	student.Constraints = append(student.Constraints, pgutil.FKConstraintInfo{Name: "fk_student_application", Local: "application_id", Referenced: "id", ReferencedTable: "pkt_organization.tb_application"})
+	levels, err = DependencyLevels([]*pgutil.TableInfo{&student, tableMap["pkt_organization.tb_application"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 || levels[0][0].Name != "tb_application" {
+		t.Fatalf("niveles inesperados: %v", levels)
+	}
+
+	//Ciclo sin claves foráneas nulas
+	application := *tableMap["pkt_organization.tb_application"]
+	application.Columns = []pgutil.ColumnInfo{{Name: "id", DataType: "integer", IsPrimaryKey: true}, {Name: "student_id", DataType: "integer"}}
+	if _, err := DependencyLevels([]*pgutil.TableInfo{&student, &application}); err == nil {
+		t.Fatal("se esperaba un error por el ciclo de claves foráneas no nulas")
+	}
+}
+
+func TestKeyRangeArgs(t *testing.T) {
+	r := keyRange{from: []interface{}{10}, to: []interface{}{20}}
+	if args := r.args(nil); len(args) != 2 || args[0] != 10 || args[1] != 20 {
+		t.Fatalf("parámetros inesperados: %v", args)
+	}
+	if args := r.args([]interface{}{15}); len(args) != 2 || args[0] != 15 || args[1] != 20 {
+		t.Fatalf("parámetros inesperados: %v", args)
+	}
+	if args := (keyRange{}).args(nil); len(args) != 0 {
+		t.Fatalf("parámetros inesperados: %v", args)
+	}
+}
+
+func TestState(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "state.json")
+	state, err := LoadState(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Watermark("pkt_organization.tb_student"); ok {
+		t.Fatal("el estado nuevo no debería tener marcas de agua")
+	}
+	if err := state.SetWatermark("pkt_organization.tb_student", "2024-05-01 10:00:00+00"); err != nil {
+		t.Fatal(err)
+	}
+	state, err = LoadState(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watermark, ok := state.Watermark("pkt_organization.tb_student"); !ok || watermark != "2024-05-01 10:00:00+00" {
+		t.Fatalf("marca de agua inesperada: %q", watermark)
+	}
+}
+
+func TestStateProgress(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "state.json")
+	state, err := LoadState(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := []keyRange{{to: []interface{}{int64(500)}}, {from: []interface{}{int64(500)}}}
+	if err := state.StartTable("pkt_organization.tb_student", "", ranges); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SaveLastKey("pkt_organization.tb_student", 0, []interface{}{int64(250)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.FinishRange("pkt_organization.tb_student", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = LoadState(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, ok := state.TableProgress("pkt_organization.tb_student")
+	if !ok {
+		t.Fatal("no se guardó el avance de la tabla")
+	}
+	resumed := resumeRanges(progress.Ranges)
+	if len(resumed) != 2 || resumed[0].done || !resumed[1].done {
+		t.Fatalf("rangos inesperados: %+v", resumed)
+	}
+	if args := resumed[0].args(resumed[0].lastKey); len(args) != 2 || args[0] != "250" || args[1] != "500" {
+		t.Fatalf("parámetros inesperados: %v", args)
+	}
+
+	if err := state.CompleteTable("pkt_organization.tb_student"); err != nil {
+		t.Fatal(err)
+	}
+	if progress, _ := state.TableProgress("pkt_organization.tb_student"); !progress.Completed {
+		t.Fatal("la tabla debería estar completa")
+	}
+	if err := state.ResetProgress(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.TableProgress("pkt_organization.tb_student"); ok {
+		t.Fatal("el avance debería haberse descartado")
+	}
+}
+
+func TestPlanString(t *testing.T) {
+	plan := &Plan{Tables: []*TablePlan{
+		{Table: "pkt_organization.nom_gender", Level: 0, Insert: 2, Unchanged: 1},
+		{Table: "pkt_organization.tb_application", Level: 1, Error: "missing table"},
+	}}
+	if !plan.HasErrors() {
+		t.Fatal("el plan debería tener errores")
+	}
+	lines := strings.Split(strings.TrimSpace(plan.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("líneas inesperadas: %q", lines)
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != "0 pkt_organization.nom_gender 2 0 1 0 0" {
+		t.Errorf("fila inesperada: %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], "missing table") {
+		t.Errorf("fila sin el error: %q", lines[2])
+	}
+}
+
+func TestOrphanCountQuery(t *testing.T) {
+	tableMap := testTableMap(t)
+	student := tableMap["pkt_organization.tb_student"]
+	application := tableMap["pkt_organization.tb_application"]
+	query := orphanCountQuery(application, student, application.Constraints[0], "id > 10", "province_id = 5")
+	want := `SELECT COUNT(*) FROM "pkt_organization"."tb_application" AS c WHERE c."student_id" IS NOT NULL AND NOT EXISTS (SELECT 1 FROM "pkt_organization"."tb_student" AS p WHERE p."id" = c."student_id" AND (province_id = 5)) AND (id > 10)`
+	if query != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", query, want)
+	}
+	warnings, err := FilterWarnings(context.Background(), nil, []*pgutil.TableInfo{student, application}, nil)
+	if err != nil || len(warnings) != 0 {
+		t.Errorf("sin filtros no debería haber avisos: %v %v", warnings, err)
+	}
+}
+
+func TestSubsetQueries(t *testing.T) {
+	tableMap := testTableMap(t)
+	student := tableMap["pkt_organization.tb_student"]
+	application := tableMap["pkt_organization.tb_application"]
+	fk := application.Constraints[0]
+	parents := parentKeysQuery(application, student, fk, []string{"id"}, []string{"id"}, 2)
+	want := `SELECT p."id" FROM "pkt_organization"."tb_student" AS p WHERE p."id" IN (SELECT c."student_id" FROM "pkt_organization"."tb_application" AS c WHERE (c."id") IN ($1, $2))`
+	if parents != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", parents, want)
+	}
+	children := childKeysQuery(application, student, fk, []string{"id"}, []string{"id"}, 1)
+	want = `SELECT c."id" FROM "pkt_organization"."tb_application" AS c WHERE c."student_id" IN (SELECT p."id" FROM "pkt_organization"."tb_student" AS p WHERE (p."id") IN ($1))`
+	if children != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", children, want)
+	}
+	if size := keysPerQuery(2, 50000); size != 32767 {
+		t.Errorf("claves por consulta inesperadas: %d", size)
+	}
+}
+
+func TestMapping(t *testing.T) {
+	tableMap := testTableMap(t)
+	student := tableMap["pkt_organization.tb_student"]
+	opts := &Options{Tables: map[string]TableOptions{
+		"pkt_organization.tb_student": {Target: "pkt_people.student", Columns: map[string]string{"name": "full_name", "gender_id": ""}},
+		"pkt_encoders.nom_gender":     {Target: "pkt_people.gender"},
+	}}
+	m, err := opts.mapping(student, []string{"id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.target.TableName() != "pkt_people.student" || strings.Join(m.target.ColumnNames(), ",") != "id,full_name" {
+		t.Fatalf("tabla destino inesperada: %s %v", m.target.TableName(), m.target.ColumnNames())
+	}
+	if len(m.target.Constraints) != 0 {
+		t.Errorf("la clave foránea de una columna omitida no debería copiarse: %v", m.target.Constraints)
+	}
+	projected := m.project([][]interface{}{{int64(1), "Ana", int64(2)}})
+	if len(projected[0]) != 2 || projected[0][1] != "Ana" {
+		t.Errorf("fila inesperada: %v", projected)
+	}
+	if got := m.target.InsertQuery(); got != `INSERT INTO "pkt_people"."student" ("id", "full_name") VALUES ($1, $2)` {
+		t.Errorf("consulta inesperada: %s", got)
+	}
+
+	opts.Tables["pkt_organization.tb_student"] = TableOptions{Columns: map[string]string{"id": ""}}
+	if _, err := opts.mapping(student, []string{"id"}); err == nil {
+		t.Error("omitir la clave primaria debería fallar")
+	}
+
+	delete(opts.Tables, "pkt_organization.tb_student")
+	m, err = opts.mapping(student, []string{"id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fk := m.target.Constraints[0]; fk.ReferencedTable != "pkt_people.gender" {
+		t.Errorf("la clave foránea debería referenciar la tabla destino del padre: %s", fk.ReferencedTable)
+	}
+}
+
+func TestTransformBatch(t *testing.T) {
+	table := testTableMap(t)["pkt_organization.tb_student"]
+	cast, err := Cast("gender_id", "integer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := RowFunc(func(table *pgutil.TableInfo, row []interface{}) ([][]interface{}, error) {
+		if row[0] == int64(2) {
+			return nil, nil
+		}
+		copied := append([]interface{}{}, row...)
+		copied[0] = row[0].(int64) + 100
+		return [][]interface{}{row, copied}, nil
+	})
+	opts := &Options{
+		Transformers: map[string][]Transformer{AllTables: {Trim("name")}, table.TableName(): {cast, split}},
+		Tables:       map[string]TableOptions{table.TableName(): {Transforms: []TransformOptions{{Column: "name", Kind: "upper"}}}},
+	}
+	transformers, err := opts.transformers(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := [][]interface{}{{int64(1), "  ana ", []byte("3")}, {int64(2), "luis", nil}}
+	batch, err = transformBatch(table, transformers, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 || batch[0][1] != "ANA" || batch[0][2] != int64(3) || batch[1][0] != int64(101) {
+		t.Fatalf("lote inesperado: %v", batch)
+	}
+
+	opts.Tables[table.TableName()] = TableOptions{Transforms: []TransformOptions{{Column: "name", Kind: "reverse"}}}
+	if _, err := opts.transformers(table); err == nil {
+		t.Error("una transformación desconocida debería fallar")
+	}
+}
+
+func TestMask(t *testing.T) {
+	tableMap := testTableMap(t)
+	student := tableMap["pkt_organization.tb_student"]
+	application := tableMap["pkt_organization.tb_application"]
+	opts := &Options{MaskSecret: "secret", Tables: map[string]TableOptions{
+		student.TableName():     {Mask: map[string]MaskOptions{"id": {Strategy: MASK_HASH}, "name": {Strategy: MASK_NAME}}},
+		application.TableName(): {Mask: map[string]MaskOptions{"student_id": {Strategy: MASK_HASH}}},
+	}}
+	mask := func(table *pgutil.TableInfo, row []interface{}) []interface{} {
+		transformers, err := opts.transformers(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch, err := transformBatch(table, transformers, [][]interface{}{row})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return batch[0]
+	}
+	first := mask(student, []interface{}{int64(7), "Juan Pérez", int64(1)})
+	second := mask(student, []interface{}{int64(7), "Juan Pérez", int64(1)})
+	child := mask(application, []interface{}{int64(1), int64(7)})
+	if first[0] == int64(7) || first[1] == "Juan Pérez" {
+		t.Fatalf("la fila no se enmascaró: %v", first)
+	}
+	if first[0] != second[0] || first[1] != second[1] {
+		t.Errorf("el enmascaramiento no es determinista: %v %v", first, second)
+	}
+	if child[1] != first[0] {
+		t.Errorf("la clave foránea enmascarada no coincide: %v %v", child[1], first[0])
+	}
+
+	redact, err := Mask(pgutil.ColumnInfo{Name: "name"}, MaskOptions{Strategy: MASK_REDACT, Keep: 2}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := redact.Transform(student, []interface{}{int64(1), "12345678", nil})
+	if err != nil || rows[0][1] != "******78" {
+		t.Errorf("valor inesperado: %v %v", rows, err)
+	}
+	if _, err := Mask(pgutil.ColumnInfo{Name: "name"}, MaskOptions{Strategy: MASK_NAME}, ""); err == nil {
+		t.Error("enmascarar sin secreto debería fallar")
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	table := testTableMap(t)["pkt_organization.tb_student"]
+	opts := &Options{Tables: map[string]TableOptions{table.TableName(): {Conflict: CONFLICT_NEWER, ConflictColumn: "gender_id"}}}
+	m, err := opts.mapping(table, []string{"id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := opts.conflictPolicy(table, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := []interface{}{int64(1), "Ana", int64(5)}
+	if row, _ := cp.resolve(m.target, source, []interface{}{int64(1), "Ana", int64(3)}); row == nil {
+		t.Error("la fila más nueva del origen debería escribirse")
+	}
+	if row, _ := cp.resolve(m.target, source, []interface{}{int64(1), "Ana", int64(9)}); row != nil {
+		t.Error("la fila más nueva del destino debería quedarse")
+	}
+
+	opts.Tables[table.TableName()] = TableOptions{Conflict: CONFLICT_NEWER}
+	if _, err := opts.conflictPolicy(table, m); err == nil {
+		t.Error("la política newer sin columna debería fallar")
+	}
+	opts.Tables[table.TableName()] = TableOptions{}
+	opts.Resolvers = map[string]ConflictFunc{table.TableName(): func(table *pgutil.TableInfo, source, destination []interface{}) ([]interface{}, error) {
+		merged := append([]interface{}{}, destination...)
+		merged[1] = source[1]
+		return merged, nil
+	}}
+	if cp, err = opts.conflictPolicy(table, m); err != nil || cp.policy != CONFLICT_CUSTOM {
+		t.Fatalf("política inesperada: %v %v", cp, err)
+	}
+	if row, _ := cp.resolve(m.target, source, []interface{}{int64(1), "Luis", int64(9)}); row[1] != "Ana" || row[2] != int64(9) {
+		t.Errorf("fila inesperada: %v", row)
+	}
+}
+
+func TestDeferredKeys(t *testing.T) {
+	tableMap := testTableMap(t)
+	//Ciclo entre tb_student y tb_application y referencia de tb_application a sí misma
+	student := *tableMap["pkt_organization.tb_student"]
+	student.Columns = append(student.Columns, pgutil.ColumnInfo{Name: "application_id", DataType: "integer"})
+	student.Constraints = append(student.Constraints, pgutil.FKConstraintInfo{Name: "fk_student_application", Local: "application_id", Referenced: "id", ReferencedTable: "pkt_organization.tb_application"})
+	application := *tableMap["pkt_organization.tb_application"]
+	application.Columns = append(application.Columns, pgutil.ColumnInfo{Name: "parent_id", DataType: "integer", IsNullable: true})
+	application.Constraints = append(application.Constraints, pgutil.FKConstraintInfo{Name: "fk_application_parent", Local: "parent_id", Referenced: "id", ReferencedTable: "pkt_organization.tb_application"})
+	levels, err := DependencyLevels([]*pgutil.TableInfo{&student, &application, tableMap["pkt_encoders.nom_gender"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deferred := deferredKeys(levels)
+	if got := strings.Join(deferred["pkt_organization.tb_application"], ","); got != "student_id,parent_id" {
+		t.Errorf("columnas diferidas inesperadas: %s", got)
+	}
+	if len(deferred["pkt_organization.tb_student"]) != 0 {
+		t.Errorf("tb_student no debería tener columnas diferidas: %v", deferred)
+	}
+	query := backfillQuery(&application, application.Constraints[1], []string{"id"})
+	want := `UPDATE "pkt_organization"."tb_application" SET "parent_id" = $1 WHERE ("id") = ($2) AND "parent_id" IS NULL AND EXISTS (SELECT 1 FROM "pkt_organization"."tb_application" WHERE "id" = $1)`
+	if query != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", query, want)
+	}
+
+	//La segunda fase lee las filas con las condiciones de la primera, y nada si la primera no tenía filas
+	opts := &Options{phaseOne: &phaseOne{read: map[string]phaseOneRead{}, kept: map[string]map[string]bool{}}}
+	opts.recordRead(application.TableName(), phaseOneRead{conditions: []string{`"updated_at" > '2024-04-01'`}})
+	opts.recordRead(student.TableName(), phaseOneRead{empty: true})
+	if read, ok := opts.phaseOneRead(application.TableName()); !ok || strings.Join(read.conditions, "") != `"updated_at" > '2024-04-01'` {
+		t.Errorf("lectura inesperada de la primera fase: %v", read)
+	}
+	if _, ok := opts.phaseOneRead(tableMap["pkt_encoders.nom_gender"].TableName()); ok {
+		t.Error("nom_gender no se leyó en la primera fase")
+	}
+	//Las filas que la política de conflictos dejó en el destino no se completan
+	opts.recordKept(application.TableName(), []interface{}{int64(7)})
+	if !opts.isKept(application.TableName(), []interface{}{int64(7)}) || opts.isKept(application.TableName(), []interface{}{int64(8)}) {
+		t.Error("filas dejadas por la política de conflictos inesperadas")
+	}
+	ts := &tableSync{table: &student, opts: opts}
+	if err := ts.backfill(context.Background()); err != nil {
+		t.Errorf("la segunda fase no debería leer una tabla sin filas: %v", err)
+	}
+}
+
+func TestPlanLevels(t *testing.T) {
+	tableMap := testTableMap(t)
+	//Ciclo entre tb_student y tb_application sin claves que acepten nulos
+	student := *tableMap["pkt_organization.tb_student"]
+	student.Columns = append(student.Columns, pgutil.ColumnInfo{Name: "application_id", DataType: "integer"})
+	student.Constraints = append(student.Constraints, pgutil.FKConstraintInfo{Name: "fk_student_application", Local: "application_id", Referenced: "id", ReferencedTable: "pkt_organization.tb_application"})
+	application := *tableMap["pkt_organization.tb_application"]
+	application.Columns = []pgutil.ColumnInfo{{Name: "id", DataType: "integer", IsPrimaryKey: true}, {Name: "student_id", DataType: "integer"}}
+	selected := []*pgutil.TableInfo{&student, &application}
+	if _, _, err := syncLevels(selected, nil); err == nil {
+		t.Error("se esperaba un error por el ciclo")
+	}
+	levels, _, err := syncLevels(selected, &Options{SingleTransaction: true})
+	if err != nil || len(levels) != 1 {
+		t.Fatalf("la transacción única copia el ciclo en un nivel: %v %v", levels, err)
+	}
+	//Con el padre en el mismo nivel la clave foránea solo se cuenta como copiada si se valida al final
+	tp := &tablePlanner{plan: &TablePlan{Level: 0}, levelOf: map[string]int{student.TableName(): 0, application.TableName(): 0}}
+	fk := application.Constraints[0]
+	if tp.parentSynced(&application, fk, nil) {
+		t.Error("el padre del mismo nivel no existe aún en el destino")
+	}
+	if !tp.parentSynced(&application, fk, &Options{SingleTransaction: true}) {
+		t.Error("la transacción única valida las claves al confirmar")
+	}
+	if !tp.parentSynced(&application, fk, &Options{deferred: map[string][]string{application.TableName(): {"student_id"}}}) {
+		t.Error("la clave diferida se completa en la segunda fase")
+	}
+	tp.plan.Level = 1
+	if !tp.parentSynced(&application, fk, nil) {
+		t.Error("el padre de un nivel anterior ya se copió")
+	}
+	//En dos fases se calculan las claves diferidas igual que en SyncTables
+	cycle := application
+	cycle.Columns = []pgutil.ColumnInfo{{Name: "id", DataType: "integer", IsPrimaryKey: true}, {Name: "student_id", DataType: "integer", IsNullable: true}}
+	levels, opts, err := syncLevels([]*pgutil.TableInfo{&student, &cycle}, &Options{TwoPhase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(opts.deferred[cycle.TableName()], ","); got != "student_id" || len(levels) != 2 {
+		t.Errorf("claves diferidas inesperadas: %s", got)
+	}
+}
+
+func TestParentConditions(t *testing.T) {
+	tableMap := testTableMap(t)
+	gender := tableMap["pkt_encoders.nom_gender"]
+	student := tableMap["pkt_organization.tb_student"]
+	application := tableMap["pkt_organization.tb_application"]
+	opts := &Options{Tables: map[string]TableOptions{
+		gender.TableName():  {Where: "active"},
+		student.TableName(): {Where: "enrolled"},
+	}}
+	planned := map[string]*tableSync{student.TableName(): {conditions: []string{"enrolled", `"updated_at" > '2024-04-01'`}}}
+	ts := &tableSync{table: application, opts: opts, conditions: []string{"open"}, plan: &tablePlanner{planned: planned}}
+	cases := map[*pgutil.TableInfo]string{
+		application: "open",
+		student:     `enrolled AND "updated_at" > '2024-04-01'`,
+		gender:      "active",
+	}
+	for parent, want := range cases {
+		if got := strings.Join(ts.parentConditions(parent), " AND "); got != want {
+			t.Errorf("condiciones de %s: se esperaba %s, se obtuvo %s", parent.TableName(), want, got)
+		}
+	}
+}
+
+func TestSingleTransaction(t *testing.T) {
+	opts := &Options{SingleTransaction: true, Resume: true}
+	err := SyncTablesContext(context.Background(), nil, nil, []string{"pkt_encoders.nom_gender"}, testCatalog(t), opts)
+	if err == nil || !strings.Contains(err.Error(), "single transaction") {
+		t.Errorf("se esperaba un error por reanudar en una transacción única: %v", err)
+	}
+	//Los lotes no confirman ni deshacen la transacción compartida
+	var tx transaction = sharedTx{}
+	if tx.Commit() != nil || tx.Rollback() != nil {
+		t.Error("la transacción de un lote no debería cerrar la transacción única")
+	}
+}
+
+func TestSuppressTriggers(t *testing.T) {
+	table := testTableMap(t)["pkt_encoders.nom_gender"]
+	opts := &Options{Triggers: TRIGGERS_DISABLE, Tables: map[string]TableOptions{table.TableName(): {Target: "catalog.gender"}}}
+	target := splitTableName(opts.targetName(table.TableName()))
+	if query := disableTriggersQuery(target); query != `ALTER TABLE "catalog"."gender" DISABLE TRIGGER USER` {
+		t.Errorf("consulta inesperada: %s", query)
+	}
+	if query := enableTriggersQuery(target); query != `ALTER TABLE "catalog"."gender" ENABLE TRIGGER USER` {
+		t.Errorf("consulta inesperada: %s", query)
+	}
+	//Los modos que no tocan las tablas no usan el destino
+	for _, mode := range []string{TRIGGERS_FIRE, TRIGGERS_REPLICA} {
+		restore, err := suppressTriggers(context.Background(), nil, []*pgutil.TableInfo{table}, &Options{Triggers: mode})
+		if err != nil || restore() != nil {
+			t.Errorf("el modo %q no debería fallar: %v", mode, err)
+		}
+	}
+	if _, err := suppressTriggers(context.Background(), nil, []*pgutil.TableInfo{table}, &Options{Triggers: "off"}); err == nil {
+		t.Error("se esperaba un error por un modo desconocido")
+	}
+	if !(&Options{Triggers: TRIGGERS_REPLICA}).replica() || (*Options)(nil).replica() {
+		t.Error("replica inesperado")
+	}
+}
+
+func TestSequences(t *testing.T) {
+	table := testTableMap(t)["pkt_encoders.nom_gender"]
+	query := setSequenceQuery(table, "id")
+	want := `SELECT setval($1::regclass, v) FROM (SELECT GREATEST((SELECT MAX("id") FROM "pkt_encoders"."nom_gender"), $2::bigint, pg_sequence_last_value($1::regclass)) AS v) s WHERE v IS NOT NULL`
+	if query != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", query, want)
+	}
+	if _, err := newTableSync(nil, nil, table, &Options{Sequences: "min"}); err == nil {
+		t.Error("se esperaba un error por un modo de secuencias desconocido")
+	}
+	if mode, err := (*Options)(nil).sequences(); err != nil || mode != SEQUENCES_MAX {
+		t.Errorf("modo por defecto inesperado: %q %v", mode, err)
+	}
+}
+
+func TestIndexQuery(t *testing.T) {
+	table := *testTableMap(t)["pkt_organization.tb_student"]
+	index := pgutil.IndexInfo{Name: "ix_student_name", Columns: []string{"name"}, Definition: "CREATE INDEX ix_student_name ON pkt_organization.tb_student USING btree (name)"}
+	table.Indexes = []pgutil.IndexInfo{index}
+	//Sin cambios de nombres se usa la definición del índice
+	m, err := (*Options)(nil).mapping(&table, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query, ok := indexQuery(&table, m.target, index, nil); !ok || query != "CREATE INDEX IF NOT EXISTS ix_student_name ON pkt_organization.tb_student USING btree (name)" {
+		t.Errorf("consulta inesperada: %s", query)
+	}
+	//Con la tabla y la columna renombradas el índice se crea sobre las columnas del destino
+	opts := &Options{Tables: map[string]TableOptions{table.TableName(): {Target: "org.student", Columns: map[string]string{"name": "full_name"}}}}
+	if m, err = opts.mapping(&table, nil); err != nil {
+		t.Fatal(err)
+	}
+	if query, ok := indexQuery(&table, m.target, index, opts); !ok || query != `CREATE INDEX IF NOT EXISTS "ix_student_name" ON "org"."student" ("full_name")` {
+		t.Errorf("consulta inesperada: %s", query)
+	}
+	//Un índice sobre una columna que no se copia no se crea
+	opts.Tables[table.TableName()] = TableOptions{Columns: map[string]string{"name": ""}}
+	if m, err = opts.mapping(&table, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := indexQuery(&table, m.target, index, opts); ok {
+		t.Error("el índice usa una columna que no se copia")
+	}
+}
+
+func TestCompatibleType(t *testing.T) {
+	column := func(dataType string, length int) pgutil.ColumnInfo {
+		return pgutil.ColumnInfo{Name: "value", DataType: dataType, LengthPrecision: length}
+	}
+	cases := []struct {
+		source, destination pgutil.ColumnInfo
+		compatible          bool
+	}{
+		{column("integer", 0), column("integer", 0), true},
+		{column("integer", 0), column("bigint", 0), true},
+		{column("bigint", 0), column("integer", 0), false},
+		{column("character varying", 50), column("character varying", 100), true},
+		{column("character varying", 100), column("character varying", 50), false},
+		{column("character varying", 100), column("text", 0), true},
+		{column("text", 0), column("character varying", 100), false},
+		{column("integer", 0), column("text", 0), false},
+	}
+	for _, c := range cases {
+		if got := compatibleType(c.source, c.destination); got != c.compatible {
+			t.Errorf("%s a %s: compatible %t, se esperaba %t", c.source.TypeName(), c.destination.TypeName(), got, c.compatible)
+		}
+	}
+	table := testTableMap(t)["pkt_encoders.nom_gender"]
+	opts := &Options{Tables: map[string]TableOptions{table.TableName(): {Transforms: []TransformOptions{{Column: "name", Kind: "cast", Value: "integer"}}}}}
+	if !opts.hasCast(table, "name") || opts.hasCast(table, "id") {
+		t.Error("cast inesperado")
+	}
+	//Los Cast registrados en código también cuentan
+	cast, err := Cast("id", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := &Options{Transformers: map[string][]Transformer{AllTables: {Upper("name")}, table.TableName(): {cast}}}
+	if !registered.hasCast(table, "id") || registered.hasCast(table, "name") {
+		t.Error("cast registrado inesperado")
+	}
+}
+
+func TestCopyReader(t *testing.T) {
+	columns := []pgutil.ColumnInfo{
+		{Name: "id", DataType: "integer"},
+		{Name: "name", DataType: "text"},
+		{Name: "active", DataType: "boolean"},
+		{Name: "photo", DataType: "bytea"},
+		{Name: "created", DataType: "timestamp with time zone"},
+		{Name: "price", DataType: "numeric"},
+	}
+	stream := "1\tline\\none\\ttab \\\\ back\tt\t\\\\x0aff\t2024-05-01 10:00:00+02\t12.50\n" +
+		"2\t\\N\tf\t\\N\t\\N\t\\N\n" +
+		"3\toctal \\101\\x42\tt\t\\N\t\\N\t\\N\n"
+	cr := &copyReader{reader: bufio.NewReader(strings.NewReader(stream)), columns: columns}
+	batch, err := cr.readBatch(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 {
+		t.Fatalf("se esperaban 2 filas, se obtuvieron %d", len(batch))
+	}
+	first := batch[0]
+	if first[0] != int64(1) || first[1] != "line\none\ttab \\ back" || first[2] != true || string(first[3].([]byte)) != "\x0a\xff" {
+		t.Errorf("fila inesperada: %#v", first)
+	}
+	if created := first[4].(time.Time); !created.Equal(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("fecha inesperada: %v", created)
+	}
+	if price, ok := first[5].([]byte); !ok || string(price) != "12.50" {
+		t.Errorf("numeric inesperado: %#v", first[5])
+	}
+	if second := batch[1]; second[1] != nil || second[2] != false || second[5] != nil {
+		t.Errorf("fila inesperada: %#v", second)
+	}
+	last, err := cr.readBatch(2)
+	if err != nil || len(last) != 1 || last[0][1] != "octal AB" {
+		t.Errorf("último lote inesperado: %#v %v", last, err)
+	}
+	if empty, err := cr.readBatch(2); err != nil || len(empty) != 0 {
+		t.Errorf("se esperaba un lote vacío al terminar: %#v %v", empty, err)
+	}
+	bad := &copyReader{reader: bufio.NewReader(strings.NewReader("1\tx\n")), columns: columns}
+	if _, err := bad.readBatch(1); err == nil {
+		t.Error("se esperaba un error por una fila con menos columnas")
+	}
+}
+
+func TestUpsertRequiresPrimaryKey(t *testing.T) {
+	table := *testTableMap(t)["pkt_encoders.nom_gender"]
+	if _, err := newTableSync(nil, nil, &table, &Options{Upsert: true}); err != nil {
+		t.Fatal(err)
+	}
+	//Sin clave primaria se pagina por la clave de las opciones, pero no se puede usar ON CONFLICT
+	table.Columns = []pgutil.ColumnInfo{{Name: "id", DataType: "integer"}, {Name: "name", DataType: "character varying", LengthPrecision: 50}}
+	opts := &Options{Upsert: true, Tables: map[string]TableOptions{table.TableName(): {Key: []string{"id"}}}}
+	if _, err := newTableSync(nil, nil, &table, opts); err == nil {
+		t.Error("se esperaba un error por una tabla sin clave primaria")
+	}
+}
+
+func TestDedupeKeys(t *testing.T) {
+	table := testTableMap(t)["pkt_encoders.nom_gender"]
+	batch := [][]interface{}{{1, "a"}, {2, "b"}, {1, "c"}, {3, "d"}, {2, "e"}}
+	got := dedupeKeys(table, batch)
+	want := [][]interface{}{{1, "c"}, {3, "d"}, {2, "e"}}
+	if len(got) != len(want) {
+		t.Fatalf("se esperaban %d filas, se obtuvieron %d", len(want), len(got))
+	}
+	for i := range want {
+		if rowText(got[i]) != rowText(want[i]) {
+			t.Errorf("fila %d: se esperaba %v, se obtuvo %v", i, want[i], got[i])
+		}
+	}
+}
+
+// Driver de database/sql que guarda las sentencias ejecutadas sin conectarse a una base de datos
+type recordDriver struct{}
+
+type recordConn struct{}
+
+type recordStmt struct{ query string }
+
+// Sentencia o consulta ejecutada por recordDriver con sus argumentos
+type recordedExec struct {
+	query string
+	args  []driver.Value
+}
+
+var recorded []recordedExec
+
+func init() {
+	sql.Register("pgsync_record", recordDriver{})
+}
+
+func (recordDriver) Open(string) (driver.Conn, error) { return recordConn{}, nil }
+
+func (recordConn) Prepare(query string) (driver.Stmt, error) { return &recordStmt{query}, nil }
+func (recordConn) Close() error                              { return nil }
+func (recordConn) Begin() (driver.Tx, error)                 { return recordConn{}, nil }
+func (recordConn) Commit() error                             { return nil }
+func (recordConn) Rollback() error                           { return nil }
+
+func (s *recordStmt) Close() error  { return nil }
+func (s *recordStmt) NumInput() int { return -1 }
+func (s *recordStmt) Exec(args []driver.Value) (driver.Result, error) {
+	recorded = append(recorded, recordedExec{s.query, args})
+	return driver.RowsAffected(0), nil
+}
+func (s *recordStmt) Query(args []driver.Value) (driver.Rows, error) {
+	recorded = append(recorded, recordedExec{s.query, args})
+	return recordRows{}, nil
+}
+
+// Resultado vacío de las consultas de recordDriver
+type recordRows struct{}
+
+func (recordRows) Columns() []string         { return []string{"value"} }
+func (recordRows) Close() error              { return nil }
+func (recordRows) Next([]driver.Value) error { return io.EOF }
+
+func TestBulkSplitRows(t *testing.T) {
+	db, err := sql.Open("pgsync_record", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	//Transformación que divide cada fila en dos con la misma clave primaria
+	split := RowFunc(func(table *pgutil.TableInfo, row []interface{}) ([][]interface{}, error) {
+		return [][]interface{}{{row[0], "first"}, {row[0], "second"}}, nil
+	})
+	table := testTableMap(t)["pkt_encoders.nom_gender"]
+	opts := &Options{Bulk: true, Transformers: map[string][]Transformer{table.TableName(): {split}}}
+	ts, err := newTableSync(nil, dbDestination{DB: db}, table, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded = nil
+	if err := ts.write(context.Background(), [][]interface{}{{int64(1), "a"}, {int64(2), "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	copied := []string{}
+	for _, exec := range recorded {
+		if strings.HasPrefix(exec.query, "COPY") && len(exec.args) > 0 {
+			copied = append(copied, fmt.Sprint(exec.args[0], " ", exec.args[1]))
+		}
+	}
+	if got := strings.Join(copied, ","); got != "1 second,2 second" {
+		t.Errorf("filas copiadas inesperadas: %s", got)
+	}
+}
+
+func TestExistingValuesChunks(t *testing.T) {
+	db, err := sql.Open("pgsync_record", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	//Más valores distintos que parametros en una consulta, como con un BatchSize mayor que 65535
+	batch := make([][]interface{}, maxQueryParams+10)
+	for i := range batch {
+		batch[i] = []interface{}{int64(i)}
+	}
+	recorded = nil
+	table := testTableMap(t)["pkt_encoders.nom_gender"]
+	if _, err := existingValues(context.Background(), db, table, "id", batch, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 2 || len(recorded[0].args) != maxQueryParams || len(recorded[1].args) != 10 {
+		t.Errorf("se esperaban dos consultas de %d y 10 parametros, se hicieron %d", maxQueryParams, len(recorded))
+	}
+}
+
+func TestWatermarkConditions(t *testing.T) {
+	high := sql.NullString{String: "2024-05-01", Valid: true}
+	cases := []struct {
+		incremental bool
+		high        sql.NullString
+		want        string
+	}{
+		{false, high, `("updated_at" <= '2024-05-01' OR "updated_at" IS NULL)`},
+		{false, sql.NullString{}, `"updated_at" IS NULL`},
+		{true, high, `"updated_at" > '2024-04-01' AND "updated_at" <= '2024-05-01'`},
+	}
+	for _, c := range cases {
+		got := strings.Join(watermarkConditions("updated_at", "2024-04-01", c.incremental, c.high), " AND ")
+		if got != c.want {
+			t.Errorf("condiciones inesperadas:\n got: %s\nwant: %s", got, c.want)
+		}
+	}
+}
+
+func TestMaskIntegerKeys(t *testing.T) {
+	//MASK_HASH es una permutación del rango del tipo, las claves enmascaradas no chocan
+	column := pgutil.ColumnInfo{Name: "id", DataType: "smallint", IsPrimaryKey: true}
+	transformer, err := Mask(column, MaskOptions{Strategy: MASK_HASH}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &pgutil.TableInfo{Scheme: "public", Name: "tb_code", Columns: []pgutil.ColumnInfo{column}}
+	seen := map[int64]int64{}
+	for id := int64(-32768); id <= 32767; id++ {
+		rows, err := transformer.Transform(table, []interface{}{id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		masked := rows[0][0].(int64)
+		if masked < -32768 || masked > 32767 {
+			t.Fatalf("%d enmascarado fuera del rango de smallint: %d", id, masked)
+		}
+		if previous, ok := seen[masked]; ok {
+			t.Fatalf("%d y %d enmascaran al mismo valor %d", previous, id, masked)
+		}
+		seen[masked] = id
+	}
+	if _, err := transformer.Transform(table, []interface{}{int64(40000)}); err == nil {
+		t.Error("se esperaba un error por un valor fuera del rango de smallint")
+	}
+
+	//Una clave foránea integer a una clave primaria bigint se enmascara con el rango de bigint
+	tableMap := testTableMap(t)
+	gender := *tableMap["pkt_encoders.nom_gender"]
+	gender.Columns = []pgutil.ColumnInfo{{Name: "id", DataType: "bigint", IsPrimaryKey: true}, gender.Columns[1]}
+	tableMap[gender.TableName()] = &gender
+	student := tableMap["pkt_organization.tb_student"]
+	opts := (&Options{MaskSecret: "secret", Tables: map[string]TableOptions{
+		gender.TableName():  {Mask: map[string]MaskOptions{"id": {Strategy: MASK_HASH}}},
+		student.TableName(): {Mask: map[string]MaskOptions{"gender_id": {Strategy: MASK_HASH}}},
+	}}).withCatalog(tableMap)
+	mask := func(table *pgutil.TableInfo, row []interface{}) []interface{} {
+		transformers, err := opts.transformers(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch, err := transformBatch(table, transformers, [][]interface{}{row})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return batch[0]
+	}
+	parent := mask(&gender, []interface{}{int64(3), "F"})
+	child := mask(student, []interface{}{int64(1), "Ana", int64(3)})
+	if parent[0] != child[2] {
+		t.Errorf("la clave foránea enmascarada no coincide: %v %v", child[2], parent[0])
+	}
+
+	short := pgutil.ColumnInfo{Name: "code", DataType: "character varying", LengthPrecision: 8, IsPrimaryKey: true}
+	if _, err := Mask(short, MaskOptions{Strategy: MASK_HASH}, "secret"); err == nil {
+		t.Error("se esperaba un error al enmascarar con hash una clave de texto corta")
+	}
+}
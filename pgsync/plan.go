@@ -0,0 +1,416 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Plan describe lo que haría SyncTables sin escribir en el destino
+type Plan struct {
+	Tables   []*TablePlan `json:"tables"`             //Tablas en el orden en que se copiarían
+	Warnings []string     `json:"warnings,omitempty"` //Avisos de los filtros, ver FilterWarnings
+}
+
+// Conteo de filas de una tabla en el plan
+type TablePlan struct {
+	Table     string `json:"table"`
+	Level     int    `json:"level"`             //Nivel de dependencias, las tablas de un mismo nivel se copian a la vez
+	Insert    int64  `json:"insert"`            //Filas del origen que no existen en el destino
+	Update    int64  `json:"update"`            //Filas que existen en el destino con valores distintos
+	Unchanged int64  `json:"unchanged"`         //Filas que existen en el destino con los mismos valores
+	Delete    int64  `json:"delete,omitempty"`  //Filas del destino cuya clave no existe en el origen, solo en modo espejo
+	NulledFKs int64  `json:"nulledFks"`         //Filas con alguna clave foránea que se pondría en NULL
+	Error     string `json:"error,omitempty"`   //Error de CheckConstraints u otro que impide copiar la tabla
+	Skipped   bool   `json:"skipped,omitempty"` //La tabla ya se copió y se omitiría al reanudar
+	NoTable   bool   `json:"noTable,omitempty"` //La tabla no existe en el destino
+}
+
+// Retorna true si alguna tabla del plan tiene error
+func (p *Plan) HasErrors() bool {
+	for _, table := range p.Tables {
+		if table.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Retorna el plan en formato JSON
+func (p *Plan) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// Método String() para Plan, una tabla de texto con una fila por tabla
+func (p *Plan) String() string {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LEVEL\tTABLE\tINSERT\tUPDATE\tUNCHANGED\tDELETE\tNULLED FKS\tNOTES")
+	for _, table := range p.Tables {
+		notes := table.Error
+		if table.Skipped {
+			notes = "already completed"
+		} else if table.NoTable && notes == "" {
+			notes = "missing in destination"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n", table.Level, table.Table, table.Insert, table.Update, table.Unchanged, table.Delete, table.NulledFKs, notes)
+	}
+	w.Flush()
+	for _, warning := range p.Warnings {
+		fmt.Fprintf(&sb, "warning: %s\n", warning)
+	}
+	return sb.String()
+}
+
+// Calcula el plan de SyncTables con las mismas opciones, leyendo el origen y comparando con el destino sin escribir
+func PlanSync(ctx context.Context, src, dst *sql.DB, tables []string, catalog pgutil.Catalog, opts *Options) (*Plan, error) {
+	info, err := catalog.GetDataBaseInfo()
+	if err != nil {
+		return nil, err
+	}
+	tableMap := map[string]*pgutil.TableInfo{}
+	for _, table := range info.Tables {
+		tableMap[table.TableName()] = table
+	}
+	selected := []*pgutil.TableInfo{}
+	for _, tableName := range tables {
+		table, ok := tableMap[tableName]
+		if !ok {
+			return nil, fmt.Errorf("table %s not found in catalog", tableName)
+		}
+		selected = append(selected, table)
+	}
+	opts = opts.withCatalog(tableMap)
+	levels, opts, err := syncLevels(selected, opts)
+	if err != nil {
+		return nil, err
+	}
+	levelOf := map[string]int{}
+	for i, level := range levels {
+		for _, table := range level {
+			levelOf[table.TableName()] = i
+		}
+	}
+	if opts, err = opts.withState(); err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.Snapshot && opts.SnapshotID == "" {
+		snapshot, err := ExportSnapshot(src)
+		if err != nil {
+			return nil, err
+		}
+		defer snapshot.Close()
+		snapshotOpts := *opts
+		snapshotOpts.SnapshotID = snapshot.ID
+		opts = &snapshotOpts
+	}
+
+	warnings, err := FilterWarnings(ctx, src, selected, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts, err = opts.withSubset(ctx, src, selected); err != nil {
+		return nil, err
+	}
+	plan := &Plan{Tables: []*TablePlan{}, Warnings: warnings}
+	planned := map[string]*tableSync{}
+	for i, level := range levels {
+		for _, table := range level {
+			tablePlan := &TablePlan{Table: table.TableName(), Level: i}
+			plan.Tables = append(plan.Tables, tablePlan)
+			if err := CheckConstraints(table, tableMap); err != nil {
+				tablePlan.Error = err.Error()
+				continue
+			}
+			ts, warnings, err := openTableSync(ctx, src, dbDestination{DB: dst}, table, opts)
+			if err != nil {
+				tablePlan.Error = err.Error()
+				continue
+			}
+			plan.Warnings = append(plan.Warnings, warnings...)
+			ts.plan = &tablePlanner{plan: tablePlan, tableMap: tableMap, levelOf: levelOf, planned: planned}
+			if err := ts.plan.checkDestination(ctx, ts.dst, ts.mapping.target); err != nil {
+				return nil, err
+			}
+			if err := ts.run(ctx); err != nil {
+				return nil, err
+			}
+			planned[table.TableName()] = ts
+		}
+	}
+	// En modo espejo contar las filas que se borrarían, en el mismo orden inverso que SyncTables
+	if opts != nil && opts.Mirror {
+		for i := len(levels) - 1; i >= 0; i-- {
+			for _, table := range levels[i] {
+				if ts, ok := planned[table.TableName()]; ok {
+					if err := ts.mirror(ctx); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	return plan, nil
+}
+
+// Compara los lotes leídos del origen con el destino en lugar de escribirlos
+type tablePlanner struct {
+	plan     *TablePlan
+	tableMap map[string]*pgutil.TableInfo //Tablas del catálogo
+	levelOf  map[string]int               //Nivel de las tablas que se copian en la misma sincronización
+	planned  map[string]*tableSync        //Tablas ya comparadas, con las condiciones con que se leyeron
+	mu       sync.Mutex                   //Protege el error y subset, los lotes de una tabla se comparan a la vez
+	subset   map[string]map[string]bool   //Valores de las columnas referenciadas en el subconjunto del padre, por tabla y columna
+}
+
+// Guarda el primer error de la tabla en el plan
+func (tp *tablePlanner) fail(err string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.plan.Error == "" {
+		tp.plan.Error = err
+	}
+}
+
+// Retorna true si al escribir la clave foránea de la tabla ya existirán en el destino las filas del padre que se
+// copian en la misma sincronización: el padre es de un nivel anterior o es la misma tabla, la columna se completa
+// en la segunda fase de la carga, o la transacción única valida las claves al confirmar
+func (tp *tablePlanner) parentSynced(table *pgutil.TableInfo, fk pgutil.FKConstraintInfo, opts *Options) bool {
+	parentLevel, ok := tp.levelOf[fk.ReferencedTable]
+	if !ok {
+		return false
+	}
+	if parentLevel < tp.plan.Level || fk.ReferencedTable == table.TableName() {
+		return true
+	}
+	if opts == nil {
+		return false
+	}
+	return opts.SingleTransaction || findColumnIndex(opts.deferred[table.TableName()], fk.Local) >= 0
+}
+
+// Verifica si la tabla existe en el destino, si no existe todas sus filas serían inserciones
+func (tp *tablePlanner) checkDestination(ctx context.Context, dst reader, table *pgutil.TableInfo) error {
+	exists, err := tableExists(ctx, dst, table.TableName())
+	if err != nil {
+		return err
+	}
+	tp.plan.NoTable = !exists
+	return nil
+}
+
+// Cuenta las filas del lote que se insertarían, actualizarían o quedarían igual, y las que perderían una clave foránea
+func (ts *tableSync) planBatch(ctx context.Context, batch [][]interface{}) error {
+	tp := ts.plan
+	table := ts.table
+	columns := table.ColumnNames()
+
+	// Claves foráneas cuya fila referenciada no existe en el destino ni se copia en la misma sincronización
+	nulled := make([]bool, len(batch))
+	for _, fk := range table.Constraints {
+		index := findColumnIndex(columns, fk.Local)
+		parent, ok := tp.tableMap[fk.ReferencedTable]
+		if index < 0 || !ok {
+			continue
+		}
+		// La fila referenciada se busca en la tabla del destino del padre
+		referenced, _ := ts.opts.targetColumn(fk.ReferencedTable, fk.Referenced)
+		targetParent := splitTableName(ts.opts.targetName(fk.ReferencedTable))
+		found, err := existingValues(ctx, ts.dst, targetParent, referenced, batch, index)
+		if err != nil {
+			return err
+		}
+		if tp.parentSynced(table, fk, ts.opts) {
+			inSource, err := ts.parentValues(ctx, parent, fk.Referenced, batch, index)
+			if err != nil {
+				return err
+			}
+			for value := range inSource {
+				found[value] = true
+			}
+		}
+		for i, values := range batch {
+			if values[index] == nil || found[valueText(values[index])] {
+				continue
+			}
+			// La transacción única no pone en NULL las claves foráneas, la confirmación fallaría
+			if ts.opts != nil && ts.opts.SingleTransaction {
+				tp.fail(fmt.Sprintf("foreign key %s references rows that do not exist, the single transaction would fail to commit", fk.Name))
+				break
+			}
+			values[index] = nil
+			nulled[i] = true
+		}
+	}
+	for _, isNulled := range nulled {
+		if isNulled {
+			atomic.AddInt64(&tp.plan.NulledFKs, 1)
+		}
+	}
+
+	if tp.plan.NoTable {
+		atomic.AddInt64(&tp.plan.Insert, int64(len(batch)))
+		return nil
+	}
+
+	// Filas del destino con las mismas claves, las que la política de conflictos deja sin cambios no se actualizan
+	m := ts.mapping
+	batch = m.project(batch)
+	destination, err := ts.destinationRows(ctx, batch)
+	if err != nil {
+		return err
+	}
+	for _, values := range batch {
+		current, ok := destination[rowText(pickValues(values, m.keyIndexes))]
+		if !ok {
+			atomic.AddInt64(&tp.plan.Insert, 1)
+			continue
+		}
+		resolved, err := ts.conflict.resolve(m.target, values, current)
+		if err != nil {
+			return fmt.Errorf("error resolving conflict in %s: %w", m.target.TableName(), err)
+		}
+		if resolved == nil || rowText(resolved) == rowText(current) {
+			atomic.AddInt64(&tp.plan.Unchanged, 1)
+		} else {
+			atomic.AddInt64(&tp.plan.Update, 1)
+		}
+	}
+	return nil
+}
+
+// Retorna cuáles de los valores de la columna index del lote existen en la columna de la tabla padre entre las filas
+// del origen que la sincronización copia: las que cumplen las condiciones con que se lee el padre y, si se copia un
+// subconjunto, solo las filas del subconjunto del padre
+func (ts *tableSync) parentValues(ctx context.Context, parent *pgutil.TableInfo, column string, batch [][]interface{}, index int) (map[string]bool, error) {
+	found, err := existingValues(ctx, ts.src, parent, column, batch, index, ts.parentConditions(parent)...)
+	if err != nil || ts.opts == nil || ts.opts.Rows == nil {
+		return found, err
+	}
+	subset, err := ts.plan.subsetValues(ctx, ts.src, parent, column, ts.opts)
+	if err != nil {
+		return nil, err
+	}
+	for value := range found {
+		if !subset[value] {
+			delete(found, value)
+		}
+	}
+	return found, nil
+}
+
+// Retorna las condiciones con que se leen las filas de la tabla padre: las de la propia tabla, las de un padre ya
+// comparado, que incluyen las de la marca de agua, o el filtro de las opciones si aún no se comparó
+func (ts *tableSync) parentConditions(parent *pgutil.TableInfo) []string {
+	if parent.TableName() == ts.table.TableName() {
+		return ts.conditions
+	}
+	if planned, ok := ts.plan.planned[parent.TableName()]; ok {
+		return planned.conditions
+	}
+	if where := ts.opts.table(parent).Where; where != "" {
+		return []string{where}
+	}
+	return nil
+}
+
+// Retorna los valores de la columna de las filas del subconjunto de la tabla padre, se leen una vez por tabla y columna
+func (tp *tablePlanner) subsetValues(ctx context.Context, db reader, parent *pgutil.TableInfo, column string, opts *Options) (map[string]bool, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	cacheKey := parent.TableName() + "\x00" + column
+	if values, ok := tp.subset[cacheKey]; ok {
+		return values, nil
+	}
+	keys, err := opts.keyColumns(parent)
+	if err != nil {
+		return nil, err
+	}
+	// Tabla con solo la columna referenciada, para leer esa columna de las filas con las claves del subconjunto
+	columnTable := &pgutil.TableInfo{Scheme: parent.Scheme, Name: parent.Name, Columns: []pgutil.ColumnInfo{{Name: column}}}
+	rowKeys := opts.Rows[parent.TableName()]
+	values := map[string]bool{}
+	size := keysPerQuery(len(keys), opts.batchSize())
+	for start := 0; start < len(rowKeys); start += size {
+		batchKeys := rowKeys[start:min(start+size, len(rowKeys))]
+		rows, err := db.QueryContext(ctx, columnTable.SelectByKeysQuery(keys, len(batchKeys)), keyArgs(batchKeys)...)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching subset rows of %s: %w", parent.TableName(), err)
+		}
+		batch, err := readBatch(rows, 1, len(batchKeys))
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range batch {
+			values[valueText(row[0])] = true
+		}
+	}
+	if tp.subset == nil {
+		tp.subset = map[string]map[string]bool{}
+	}
+	tp.subset[cacheKey] = values
+	return values, nil
+}
+
+// Retorna cuáles de los valores de la columna index del lote existen en la columna de la tabla de la base de datos,
+// entre las filas que cumplen las condiciones SQL dadas. Los valores se consultan en partes que caben en los parametros de postgres
+func existingValues(ctx context.Context, db reader, table *pgutil.TableInfo, column string, batch [][]interface{}, index int, conditions ...string) (map[string]bool, error) {
+	args := []interface{}{}
+	seen := map[string]bool{}
+	for _, values := range batch {
+		if value := values[index]; value != nil && !seen[valueText(value)] {
+			seen[valueText(value)] = true
+			args = append(args, value)
+		}
+	}
+	found := map[string]bool{}
+	size := keysPerQuery(1, len(args))
+	for start := 0; start < len(args); start += size {
+		chunk := args[start:min(start+size, len(args))]
+		if err := readExistingValues(ctx, db, table.SelectExistingValuesQuery(column, len(chunk), conditions...), chunk, found); err != nil {
+			return nil, fmt.Errorf("error checking foreign key values in %s: %w", table.TableName(), err)
+		}
+	}
+	return found, nil
+}
+
+// Agrega a found los valores que devuelve la consulta
+func readExistingValues(ctx context.Context, db reader, query string, args []interface{}, found map[string]bool) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value interface{}
+		if err := rows.Scan(&value); err != nil {
+			return fmt.Errorf("error scanning foreign key values: %w", err)
+		}
+		found[valueText(value)] = true
+	}
+	return rows.Err()
+}
+
+// Representación de texto de un valor para compararlo entre el origen y el destino
+func valueText(value interface{}) string {
+	if value == nil {
+		return "NULL"
+	}
+	return keyText([]interface{}{value})[0]
+}
+
+func rowText(values []interface{}) string {
+	text := make([]string, len(values))
+	for i, value := range values {
+		text[i] = valueText(value)
+	}
+	return strings.Join(text, "\x00")
+}
@@ -0,0 +1,104 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/stellviaproject/dbmap/database"
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Valor de las secuencias del destino después de copiar una tabla. Una secuencia nunca retrocede
+const (
+	SEQUENCES_MAX    = ""       //Al mayor valor de la columna en el destino (por defecto)
+	SEQUENCES_SOURCE = "source" //Al valor actual de la secuencia del origen, o al mayor valor de la columna si es mayor
+	SEQUENCES_SKIP   = "skip"   //Las secuencias no cambian
+)
+
+// Retorna el modo de las secuencias validado
+func (opts *Options) sequences() (string, error) {
+	if opts == nil {
+		return SEQUENCES_MAX, nil
+	}
+	switch opts.Sequences {
+	case SEQUENCES_MAX, SEQUENCES_SOURCE, SEQUENCES_SKIP:
+		return opts.Sequences, nil
+	}
+	return "", fmt.Errorf("unknown sequences mode %s", opts.Sequences)
+}
+
+// Columnas de la tabla con una secuencia propia, serial o identity, y el nombre de la secuencia
+const ownedSequencesQuery = `SELECT a.attname, pg_get_serial_sequence($1, a.attname)
+FROM pg_attribute a
+WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+AND pg_get_serial_sequence($1, a.attname) IS NOT NULL`
+
+// Retorna por columna las secuencias propias de la tabla de la base de datos
+func ownedSequences(ctx context.Context, db reader, table *pgutil.TableInfo) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, ownedSequencesQuery, table.QuotedName())
+	if err != nil {
+		return nil, fmt.Errorf("error fetching sequences of %s: %w", table.TableName(), err)
+	}
+	defer rows.Close()
+	sequences := map[string]string{}
+	for rows.Next() {
+		var column, sequence string
+		if err := rows.Scan(&column, &sequence); err != nil {
+			return nil, fmt.Errorf("error scanning sequence: %w", err)
+		}
+		sequences[column] = sequence
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error fetching sequences of %s: %w", table.TableName(), err)
+	}
+	return sequences, nil
+}
+
+// Retorna la query que avanza la secuencia $1 hasta el mayor valor entre el de la columna de la tabla, $2 y el
+// valor actual de la secuencia. Retorna el nuevo valor, o ninguna fila si la tabla está vacía y la secuencia sin usar
+func setSequenceQuery(table *pgutil.TableInfo, column string) string {
+	return fmt.Sprintf(
+		"SELECT setval($1::regclass, v) FROM (SELECT GREATEST((SELECT MAX(%s) FROM %s), $2::bigint, pg_sequence_last_value($1::regclass)) AS v) s WHERE v IS NOT NULL",
+		database.QuoteIdent(column), table.QuotedName(),
+	)
+}
+
+// Avanza las secuencias propias de la tabla del destino según las opciones
+func (ts *tableSync) syncSequences(ctx context.Context) error {
+	mode, err := ts.opts.sequences()
+	if err != nil || mode == SEQUENCES_SKIP {
+		return err
+	}
+	m := ts.mapping
+	sequences, err := ownedSequences(ctx, ts.dst, m.target)
+	if err != nil {
+		return err
+	}
+	for i, column := range m.target.Columns {
+		sequence, ok := sequences[column.Name]
+		if !ok {
+			continue
+		}
+		// Valor actual de la secuencia de la columna del origen
+		var sourceValue sql.NullInt64
+		if mode == SEQUENCES_SOURCE {
+			source := ts.table.Columns[m.indexes[i]].Name
+			query := "SELECT pg_sequence_last_value(pg_get_serial_sequence($1, $2)::regclass)"
+			if err := ts.src.QueryRowContext(ctx, query, ts.table.QuotedName(), source).Scan(&sourceValue); err != nil {
+				return fmt.Errorf("error fetching source sequence of %s.%s: %w", ts.table.TableName(), source, err)
+			}
+		}
+		var value int64
+		err := ts.dst.QueryRowContext(ctx, setSequenceQuery(m.target, column.Name), sequence, sourceValue).Scan(&value)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error setting sequence %s: %w", sequence, err)
+		}
+		log.Printf("sequence %s set to %d", sequence, value)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Snapshot es una instantánea exportada del origen, las lecturas que la importan ven los datos
+// tal como estaban al exportarla aunque usen conexiones distintas
+type Snapshot struct {
+	ID string  //Identificador devuelto por pg_export_snapshot()
+	tx *sql.Tx //Transacción que exporta la instantánea, debe seguir abierta mientras se importe
+}
+
+// Abre una transacción REPEATABLE READ READ ONLY en el origen y exporta su instantánea
+func ExportSnapshot(src *sql.DB) (*Snapshot, error) {
+	tx, err := src.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("error beginning snapshot transaction: %w", err)
+	}
+	snapshot := &Snapshot{tx: tx}
+	if err := tx.QueryRow("SELECT pg_export_snapshot()").Scan(&snapshot.ID); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("error exporting snapshot: %w", err)
+	}
+	return snapshot, nil
+}
+
+// Termina la transacción que exporta la instantánea
+func (s *Snapshot) Close() error {
+	return s.tx.Rollback()
+}
+
+// reader es la parte común de *sql.DB y *sql.Tx usada para leer del origen
+type reader interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Retorna el lector del origen y la función que lo cierra. Si las opciones tienen una instantánea
+// la lectura se hace en una transacción REPEATABLE READ READ ONLY que la importa
+func openReader(ctx context.Context, src *sql.DB, opts *Options) (reader, func() error, error) {
+	if opts == nil || opts.SnapshotID == "" {
+		return src, func() error { return nil }, nil
+	}
+	tx, err := src.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error beginning read transaction: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "SET TRANSACTION SNAPSHOT "+pq.QuoteLiteral(opts.SnapshotID)); err != nil {
+		tx.Rollback()
+		return nil, nil, fmt.Errorf("error importing snapshot %s: %w", opts.SnapshotID, err)
+	}
+	return tx, tx.Rollback, nil
+}
@@ -0,0 +1,200 @@
+package pgsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Estado persistente de las sincronizaciones, se guarda en un archivo JSON entre ejecuciones
+type State struct {
+	Watermarks map[string]string         `json:"watermarks,omitempty"` //Marca de agua de la última copia incremental exitosa por tabla
+	Progress   map[string]*TableProgress `json:"progress,omitempty"`   //Avance de la sincronización en curso por tabla, para reanudarla si se interrumpe
+	fileName   string
+	mu         sync.Mutex
+}
+
+// Avance de la copia de una tabla
+type TableProgress struct {
+	Completed     bool            `json:"completed,omitempty"`     //La tabla se copió completa
+	HighWatermark string          `json:"highWatermark,omitempty"` //Marca de agua hasta la que se está copiando en modo incremental
+	Ranges        []RangeProgress `json:"ranges,omitempty"`        //Rangos de claves en que se dividió la tabla
+}
+
+// Avance de la copia de un rango de claves, las claves se guardan como texto
+type RangeProgress struct {
+	From    []string `json:"from,omitempty"`    //Inicio del rango, vacío si no tiene
+	To      []string `json:"to,omitempty"`      //Final del rango, vacío si no tiene
+	LastKey []string `json:"lastKey,omitempty"` //Clave de la última fila del último lote confirmado
+	Done    bool     `json:"done,omitempty"`    //El rango se copió completo
+}
+
+// Carga el estado desde el archivo, si el archivo no existe retorna un estado vacío que se guardará en él
+func LoadState(fileName string) (*State, error) {
+	state := &State{fileName: fileName}
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error parsing sync state %s: %w", fileName, err)
+	}
+	return state, nil
+}
+
+// Guarda el estado en su archivo, primero en un archivo temporal para no dejarlo a medias si el proceso muere
+func (s *State) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+func (s *State) save() error {
+	if s.fileName == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding sync state: %w", err)
+	}
+	tmpFile := s.fileName + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("error writing sync state: %w", err)
+	}
+	if err := os.Rename(tmpFile, s.fileName); err != nil {
+		return fmt.Errorf("error writing sync state: %w", err)
+	}
+	return nil
+}
+
+// Retorna la marca de agua de la tabla y si existe
+func (s *State) Watermark(tableName string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	watermark, ok := s.Watermarks[tableName]
+	return watermark, ok
+}
+
+// Establece la marca de agua de la tabla y guarda el estado
+func (s *State) SetWatermark(tableName, watermark string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Watermarks == nil {
+		s.Watermarks = map[string]string{}
+	}
+	s.Watermarks[tableName] = watermark
+	return s.save()
+}
+
+// Retorna una copia del avance de la tabla y si existe
+func (s *State) TableProgress(tableName string) (TableProgress, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	progress, ok := s.Progress[tableName]
+	if !ok {
+		return TableProgress{}, false
+	}
+	copied := *progress
+	copied.Ranges = append([]RangeProgress{}, progress.Ranges...)
+	return copied, true
+}
+
+// Comienza el avance de la tabla con sus rangos de claves y guarda el estado
+func (s *State) StartTable(tableName, highWatermark string, ranges []keyRange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Progress == nil {
+		s.Progress = map[string]*TableProgress{}
+	}
+	progress := &TableProgress{HighWatermark: highWatermark}
+	for _, r := range ranges {
+		progress.Ranges = append(progress.Ranges, RangeProgress{From: keyText(r.from), To: keyText(r.to)})
+	}
+	s.Progress[tableName] = progress
+	return s.save()
+}
+
+// Guarda la clave de la última fila confirmada del rango
+func (s *State) SaveLastKey(tableName string, rangeIndex int, lastKey []interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.rangeProgress(tableName, rangeIndex); r != nil {
+		r.LastKey = keyText(lastKey)
+	}
+	return s.save()
+}
+
+// Marca el rango como copiado
+func (s *State) FinishRange(tableName string, rangeIndex int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.rangeProgress(tableName, rangeIndex); r != nil {
+		r.Done = true
+	}
+	return s.save()
+}
+
+// Marca la tabla como copiada, las siguientes reanudaciones la omiten
+func (s *State) CompleteTable(tableName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Progress == nil {
+		s.Progress = map[string]*TableProgress{}
+	}
+	s.Progress[tableName] = &TableProgress{Completed: true}
+	return s.save()
+}
+
+// Descarta el avance de todas las tablas, se llama al empezar una sincronización nueva y al terminarla
+func (s *State) ResetProgress() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Progress = nil
+	return s.save()
+}
+
+func (s *State) rangeProgress(tableName string, rangeIndex int) *RangeProgress {
+	progress, ok := s.Progress[tableName]
+	if !ok || rangeIndex >= len(progress.Ranges) {
+		return nil
+	}
+	return &progress.Ranges[rangeIndex]
+}
+
+// Convierte los valores de una clave a texto para guardarlos, postgres los convierte de nuevo
+// al tipo de la columna cuando se usan como parámetros
+func keyText(values []interface{}) []string {
+	if values == nil {
+		return nil
+	}
+	text := make([]string, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case []byte:
+			text[i] = string(v)
+		case time.Time:
+			text[i] = v.Format(time.RFC3339Nano)
+		default:
+			text[i] = fmt.Sprint(v)
+		}
+	}
+	return text
+}
+
+// Convierte una clave guardada como texto en parámetros de consulta
+func keyValues(text []string) []interface{} {
+	if len(text) == 0 {
+		return nil
+	}
+	values := make([]interface{}, len(text))
+	for i, value := range text {
+		values[i] = value
+	}
+	return values
+}
@@ -0,0 +1,248 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync/atomic"
+
+	"github.com/stellviaproject/dbmap/database"
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Filas semilla de un subconjunto referencial
+type SubsetOptions struct {
+	Table    string `json:"table"`              //Tabla de las filas semilla, en la forma scheme.table
+	Where    string `json:"where"`              //Condición SQL que selecciona las filas semilla (ej. id = 1234)
+	Children bool   `json:"children,omitempty"` //Incluir también las filas hijas que referencian las filas del subconjunto
+}
+
+// Claves de las filas de un subconjunto por tabla, la clave del mapa es el nombre en la forma scheme.table.
+// Una tabla sin entrada no tiene filas en el subconjunto
+type RowSet map[string][][]interface{}
+
+// Calcula el subconjunto cerrado de filas de las tablas a partir de las filas semilla de las opciones: desde cada
+// fila se siguen sus claves foráneas hacia las filas que referencia y, si se pidió, hacia las filas hijas que la
+// referencian. De las filas alcanzadas subiendo solo se sigue subiendo, así no se arrastra toda la base de datos.
+// Solo se recorren las tablas dadas
+func Subset(ctx context.Context, src *sql.DB, tables []*pgutil.TableInfo, opts *Options) (RowSet, error) {
+	if opts == nil || opts.Subset == nil {
+		return nil, fmt.Errorf("subset requires seed rows in the options")
+	}
+	seed := opts.Subset
+	reader, closeReader, err := openReader(ctx, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader()
+
+	walk := &subsetWalk{
+		reader: reader,
+		tables: map[string]*pgutil.TableInfo{},
+		keys:   map[string][]string{},
+		rows:   map[string]map[string]*subsetRow{},
+		batch:  opts.batchSize(),
+	}
+	for _, table := range tables {
+		keys, err := opts.keyColumns(table)
+		if err != nil {
+			return nil, err
+		}
+		walk.tables[table.TableName()] = table
+		walk.keys[table.TableName()] = keys
+	}
+	seedTable, ok := walk.tables[seed.Table]
+	if !ok {
+		return nil, fmt.Errorf("subset seed table %s is not a synced table", seed.Table)
+	}
+
+	// Filas semilla
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s", database.QuoteIdentList(walk.keys[seed.Table]), seedTable.QuotedName(), seed.Where)
+	seeds, err := walk.query(ctx, query, len(walk.keys[seed.Table]))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching subset seed rows of %s: %w", seed.Table, err)
+	}
+	walk.add(seed.Table, seeds, seed.Children)
+
+	for len(walk.queue) > 0 {
+		item := walk.queue[0]
+		walk.queue = walk.queue[1:]
+		if err := walk.follow(ctx, item); err != nil {
+			return nil, err
+		}
+	}
+
+	rowSet := RowSet{}
+	for tableName, rows := range walk.rows {
+		for _, row := range rows {
+			rowSet[tableName] = append(rowSet[tableName], row.key)
+		}
+		log.Printf("subset of %s: %d rows", tableName, len(rowSet[tableName]))
+	}
+	return rowSet, nil
+}
+
+// Recorrido del subconjunto
+type subsetWalk struct {
+	reader reader
+	tables map[string]*pgutil.TableInfo     //Tablas que se recorren
+	keys   map[string][]string              //Columnas de la clave de cada tabla
+	rows   map[string]map[string]*subsetRow //Filas alcanzadas por tabla y por texto de la clave
+	queue  []subsetItem                     //Filas nuevas cuyas referencias faltan por seguir
+	batch  int                              //Claves por consulta
+}
+
+type subsetRow struct {
+	key  []interface{}
+	down bool //La fila se alcanzó bajando o es semilla, se siguen también sus filas hijas
+}
+
+type subsetItem struct {
+	table string
+	keys  [][]interface{}
+	down  bool
+}
+
+// Agrega las filas al subconjunto y encola las nuevas, o las que ahora también deben seguirse hacia abajo
+func (sw *subsetWalk) add(tableName string, keys [][]interface{}, down bool) {
+	rows, ok := sw.rows[tableName]
+	if !ok {
+		rows = map[string]*subsetRow{}
+		sw.rows[tableName] = rows
+	}
+	added := [][]interface{}{}
+	for _, key := range keys {
+		text := rowText(key)
+		if row, ok := rows[text]; ok {
+			if !down || row.down {
+				continue
+			}
+			row.down = true
+		} else {
+			rows[text] = &subsetRow{key: key, down: down}
+		}
+		added = append(added, key)
+	}
+	if len(added) > 0 {
+		sw.queue = append(sw.queue, subsetItem{table: tableName, keys: added, down: down})
+	}
+}
+
+// Sigue las claves foráneas de las filas hacia las filas que referencian y, si corresponde, hacia sus filas hijas
+func (sw *subsetWalk) follow(ctx context.Context, item subsetItem) error {
+	table := sw.tables[item.table]
+	batchSize := keysPerQuery(len(sw.keys[item.table]), sw.batch)
+	for start := 0; start < len(item.keys); start += batchSize {
+		keys := item.keys[start:min(start+batchSize, len(item.keys))]
+		args := keyArgs(keys)
+		for _, fk := range table.Constraints {
+			parent, ok := sw.tables[fk.ReferencedTable]
+			if !ok {
+				continue
+			}
+			query := parentKeysQuery(table, parent, fk, sw.keys[item.table], sw.keys[fk.ReferencedTable], len(keys))
+			parents, err := sw.query(ctx, query, len(sw.keys[fk.ReferencedTable]), args...)
+			if err != nil {
+				return fmt.Errorf("error fetching subset rows of %s referenced by %s: %w", parent.TableName(), item.table, err)
+			}
+			sw.add(fk.ReferencedTable, parents, false)
+		}
+		if !item.down {
+			continue
+		}
+		for childName, child := range sw.tables {
+			for _, fk := range child.Constraints {
+				if fk.ReferencedTable != item.table {
+					continue
+				}
+				query := childKeysQuery(child, table, fk, sw.keys[childName], sw.keys[item.table], len(keys))
+				children, err := sw.query(ctx, query, len(sw.keys[childName]), args...)
+				if err != nil {
+					return fmt.Errorf("error fetching subset rows of %s referencing %s: %w", childName, item.table, err)
+				}
+				sw.add(childName, children, true)
+			}
+		}
+	}
+	return nil
+}
+
+// Lee todas las filas de la consulta
+func (sw *subsetWalk) query(ctx context.Context, query string, columns int, args ...interface{}) ([][]interface{}, error) {
+	rows, err := sw.reader.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return readBatch(rows, columns, math.MaxInt)
+}
+
+// Retorna la query que obtiene las claves de las filas del padre referenciadas por las filas de la tabla
+// con count claves como parametros
+func parentKeysQuery(table, parent *pgutil.TableInfo, fk pgutil.FKConstraintInfo, keys, parentKeys []string, count int) string {
+	return fmt.Sprintf(
+		"SELECT %s FROM %s AS p WHERE p.%s IN (SELECT c.%s FROM %s AS c WHERE (%s) IN (%s))",
+		aliasList("p", parentKeys), parent.QuotedName(), database.QuoteIdent(fk.Referenced),
+		database.QuoteIdent(fk.Local), table.QuotedName(), aliasList("c", keys), pgutil.KeyPlaceholders(len(keys), count),
+	)
+}
+
+// Retorna la query que obtiene las claves de las filas hijas que referencian las filas del padre
+// con count claves como parametros
+func childKeysQuery(child, parent *pgutil.TableInfo, fk pgutil.FKConstraintInfo, childKeys, keys []string, count int) string {
+	return fmt.Sprintf(
+		"SELECT %s FROM %s AS c WHERE c.%s IN (SELECT p.%s FROM %s AS p WHERE (%s) IN (%s))",
+		aliasList("c", childKeys), child.QuotedName(), database.QuoteIdent(fk.Local),
+		database.QuoteIdent(fk.Referenced), parent.QuotedName(), aliasList("p", keys), pgutil.KeyPlaceholders(len(keys), count),
+	)
+}
+
+// Retorna alias.col1, alias.col2,... con las columnas entre comillas
+func aliasList(alias string, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = alias + "." + database.QuoteIdent(column)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// Retorna los valores de las claves en una sola lista de parametros
+func keyArgs(keys [][]interface{}) []interface{} {
+	args := []interface{}{}
+	for _, key := range keys {
+		args = append(args, key...)
+	}
+	return args
+}
+
+// Copia las filas con las claves dadas por lotes, las filas que no cumplen las condiciones de la copia se omiten
+func (ts *tableSync) syncKeys(ctx context.Context, reader reader, keys [][]interface{}) error {
+	table := ts.table
+	batchSize := keysPerQuery(len(ts.keys), ts.opts.batchSize())
+	fmt.Printf("Total rows to process in table %s.%s: %d\n", table.Scheme, table.Name, len(keys))
+	for start := 0; start < len(keys); start += batchSize {
+		batchKeys := keys[start:min(start+batchSize, len(keys))]
+		query := table.SelectByKeysQuery(ts.keys, len(batchKeys), ts.conditions...)
+		rows, err := reader.QueryContext(ctx, query, keyArgs(batchKeys)...)
+		if err != nil {
+			return fmt.Errorf("error fetching rows: %w", err)
+		}
+		batch, err := readBatch(rows, len(table.Columns), len(batchKeys))
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if err := ts.write(ctx, batch); err != nil {
+			return err
+		}
+		totalRows := atomic.AddInt64(&ts.totalRows, int64(len(batch)))
+		fmt.Printf("Processed %d rows from %s.%s\n", totalRows, table.Scheme, table.Name)
+	}
+	return nil
+}
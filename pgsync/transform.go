@@ -0,0 +1,256 @@
+package pgsync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Clave de Options.Transformers cuyas transformaciones se aplican a todas las tablas
+const AllTables = "*"
+
+// Transformer cambia las filas leídas del origen antes de escribirlas en el destino
+type Transformer interface {
+	// Recibe una fila con los valores en el orden de las columnas de la tabla del origen y retorna las filas
+	// que se escriben en su lugar: ninguna para descartarla, una para cambiarla o varias para dividirla
+	Transform(table *pgutil.TableInfo, row []interface{}) ([][]interface{}, error)
+}
+
+// RowFunc permite usar una función como Transformer de filas completas
+type RowFunc func(table *pgutil.TableInfo, row []interface{}) ([][]interface{}, error)
+
+func (fn RowFunc) Transform(table *pgutil.TableInfo, row []interface{}) ([][]interface{}, error) {
+	return fn(table, row)
+}
+
+// ValueFunc cambia el valor de una columna
+type ValueFunc func(value interface{}) (interface{}, error)
+
+// CastTransformer es un Transformer que cambia el tipo de los valores de algunas columnas. Al comparar las columnas
+// con las del destino esas columnas pueden tener cualquier tipo en el destino
+type CastTransformer interface {
+	Transformer
+	// Retorna las columnas del origen cuyo tipo cambia
+	CastColumns() []string
+}
+
+// Transformer que cambia el valor de una columna con una ValueFunc, las tablas sin la columna no cambian
+type columnTransformer struct {
+	column string
+	fn     ValueFunc
+	cast   bool //El valor cambia de tipo, ver Cast
+}
+
+// Retorna un Transformer que cambia el valor de la columna con fn
+func Column(column string, fn ValueFunc) Transformer {
+	return &columnTransformer{column: column, fn: fn}
+}
+
+func (ct *columnTransformer) CastColumns() []string {
+	if !ct.cast {
+		return nil
+	}
+	return []string{ct.column}
+}
+
+func (ct *columnTransformer) Transform(table *pgutil.TableInfo, row []interface{}) ([][]interface{}, error) {
+	index := findColumnIndex(table.ColumnNames(), ct.column)
+	if index < 0 {
+		return [][]interface{}{row}, nil
+	}
+	value, err := ct.fn(row[index])
+	if err != nil {
+		return nil, fmt.Errorf("error transforming column %s of %s: %w", ct.column, table.TableName(), err)
+	}
+	row[index] = value
+	return [][]interface{}{row}, nil
+}
+
+// Retorna un Transformer que pone el mismo valor en la columna de todas las filas
+func Constant(column string, value interface{}) Transformer {
+	return Column(column, func(interface{}) (interface{}, error) {
+		return value, nil
+	})
+}
+
+// Retorna un Transformer que quita los espacios al inicio y al final del texto de la columna
+func Trim(column string) Transformer {
+	return Column(column, textFunc(strings.TrimSpace))
+}
+
+// Retorna un Transformer que pasa a mayúsculas el texto de la columna
+func Upper(column string) Transformer {
+	return Column(column, textFunc(strings.ToUpper))
+}
+
+// Retorna un Transformer que pasa a minúsculas el texto de la columna
+func Lower(column string) Transformer {
+	return Column(column, textFunc(strings.ToLower))
+}
+
+// Retorna una ValueFunc que aplica fn a los valores de texto, los demás valores no cambian
+func textFunc(fn func(string) string) ValueFunc {
+	return func(value interface{}) (interface{}, error) {
+		switch v := value.(type) {
+		case string:
+			return fn(v), nil
+		case []byte:
+			return fn(string(v)), nil
+		}
+		return value, nil
+	}
+}
+
+// Retorna un Transformer que convierte el valor de la columna al tipo dado:
+// text, integer, numeric, boolean o timestamp. Los valores NULL no cambian
+func Cast(column, dataType string) (Transformer, error) {
+	var cast func(text string) (interface{}, error)
+	switch dataType {
+	case "text":
+		cast = func(text string) (interface{}, error) { return text, nil }
+	case "integer":
+		cast = func(text string) (interface{}, error) { return strconv.ParseInt(strings.TrimSpace(text), 10, 64) }
+	case "numeric":
+		cast = func(text string) (interface{}, error) {
+			// Se valida como número pero se envía como texto para no perder precisión
+			text = strings.TrimSpace(text)
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, err
+			}
+			return text, nil
+		}
+	case "boolean":
+		cast = func(text string) (interface{}, error) { return strconv.ParseBool(strings.TrimSpace(text)) }
+	case "timestamp":
+		cast = parseTimestamp
+	default:
+		return nil, fmt.Errorf("unknown cast type %s", dataType)
+	}
+	return &columnTransformer{column: column, cast: true, fn: func(value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		if t, ok := value.(time.Time); ok && dataType == "timestamp" {
+			return t, nil
+		}
+		return cast(valueText(value))
+	}}, nil
+}
+
+// Formatos de fecha que acepta Cast a timestamp
+var timestampLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02"}
+
+func parseTimestamp(text string) (interface{}, error) {
+	text = strings.TrimSpace(text)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, text); err == nil {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid timestamp %q", text)
+}
+
+// Transformación incorporada declarada en la configuración de una tabla
+type TransformOptions struct {
+	Column string `json:"column"`          //Columna del origen que se transforma
+	Kind   string `json:"kind"`            //constant, trim, upper, lower o cast
+	Value  string `json:"value,omitempty"` //Valor de constant o tipo de cast
+}
+
+// Retorna el Transformer de la transformación incorporada
+func (to TransformOptions) Transformer() (Transformer, error) {
+	switch to.Kind {
+	case "constant":
+		return Constant(to.Column, to.Value), nil
+	case "trim":
+		return Trim(to.Column), nil
+	case "upper":
+		return Upper(to.Column), nil
+	case "lower":
+		return Lower(to.Column), nil
+	case "cast":
+		return Cast(to.Column, to.Value)
+	}
+	return nil, fmt.Errorf("unknown transform %s for column %s", to.Kind, to.Column)
+}
+
+// Retorna las transformaciones de la tabla en orden: las registradas para todas las tablas, las registradas
+// para la tabla, las declaradas en sus opciones y por último el enmascaramiento de sus columnas
+func (opts *Options) transformers(table *pgutil.TableInfo) ([]Transformer, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	transformers := append([]Transformer{}, opts.Transformers[AllTables]...)
+	transformers = append(transformers, opts.Transformers[table.TableName()]...)
+	for _, to := range opts.table(table).Transforms {
+		if table.GetColumn(to.Column) == nil {
+			return nil, fmt.Errorf("transform column %s not found in table %s", to.Column, table.TableName())
+		}
+		transformer, err := to.Transformer()
+		if err != nil {
+			return nil, err
+		}
+		transformers = append(transformers, transformer)
+	}
+	for _, column := range table.Columns {
+		mask, ok := opts.table(table).Mask[column.Name]
+		if !ok {
+			continue
+		}
+		transformer, err := Mask(opts.maskColumn(table, column), mask, opts.MaskSecret)
+		if err != nil {
+			return nil, err
+		}
+		transformers = append(transformers, transformer)
+	}
+	for column := range opts.table(table).Mask {
+		if table.GetColumn(column) == nil {
+			return nil, fmt.Errorf("mask column %s not found in table %s", column, table.TableName())
+		}
+	}
+	return transformers, nil
+}
+
+// Retorna la columna que se enmascara. Una clave foránea entera se enmascara con el tipo de la columna
+// referenciada, así su valor falso coincide con el de la fila referenciada aunque los tipos sean distintos
+func (opts *Options) maskColumn(table *pgutil.TableInfo, column pgutil.ColumnInfo) pgutil.ColumnInfo {
+	if _, ok := integerBits[column.DataType]; !ok {
+		return column
+	}
+	for _, fk := range table.Constraints {
+		parent, ok := opts.catalog[fk.ReferencedTable]
+		if fk.Local != column.Name || !ok {
+			continue
+		}
+		if referenced := parent.GetColumn(fk.Referenced); referenced != nil {
+			if _, ok := integerBits[referenced.DataType]; ok {
+				column.DataType = referenced.DataType
+			}
+		}
+	}
+	return column
+}
+
+// Aplica las transformaciones a las filas del lote, cada transformación recibe las filas de la anterior
+func transformBatch(table *pgutil.TableInfo, transformers []Transformer, batch [][]interface{}) ([][]interface{}, error) {
+	for _, transformer := range transformers {
+		transformed := make([][]interface{}, 0, len(batch))
+		for _, row := range batch {
+			rows, err := transformer.Transform(table, row)
+			if err != nil {
+				return nil, err
+			}
+			for _, values := range rows {
+				if len(values) != len(table.Columns) {
+					return nil, fmt.Errorf("transformer returned a row of %s with %d values for %d columns", table.TableName(), len(values), len(table.Columns))
+				}
+			}
+			transformed = append(transformed, rows...)
+		}
+		batch = transformed
+	}
+	return batch, nil
+}
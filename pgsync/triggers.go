@@ -0,0 +1,76 @@
+package pgsync
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Supresión de los triggers del destino durante la carga
+const (
+	TRIGGERS_FIRE    = ""        //Los triggers se disparan con cada fila escrita (por defecto)
+	TRIGGERS_REPLICA = "replica" //Las transacciones de la carga usan session_replication_role = replica, no se disparan triggers ni reglas, tampoco los de las claves foráneas
+	TRIGGERS_DISABLE = "disable" //Se desactivan los triggers de usuario de las tablas del destino con ALTER TABLE ... DISABLE TRIGGER USER mientras dura la carga
+)
+
+// Retorna true si las transacciones de la carga deben usar session_replication_role = replica
+func (opts *Options) replica() bool {
+	return opts != nil && opts.Triggers == TRIGGERS_REPLICA
+}
+
+// Cambia el rol de replicación solo para la transacción, al terminar la transacción se restaura por sí solo.
+// Requiere un superusuario o, desde postgres 15, el permiso SET sobre session_replication_role
+func setReplicaRole(ctx context.Context, tx transaction) error {
+	if _, err := tx.ExecContext(ctx, "SET LOCAL session_replication_role = replica"); err != nil {
+		return fmt.Errorf("error setting session_replication_role: %w", err)
+	}
+	return nil
+}
+
+// Desactiva los triggers de usuario de las tablas del destino de las tablas dadas si las opciones lo piden.
+// Retorna la función que los vuelve a activar, se debe llamar aunque la carga falle
+func suppressTriggers(ctx context.Context, dst destination, tables []*pgutil.TableInfo, opts *Options) (func() error, error) {
+	noop := func() error { return nil }
+	if opts == nil {
+		return noop, nil
+	}
+	switch opts.Triggers {
+	case TRIGGERS_FIRE, TRIGGERS_REPLICA:
+		return noop, nil
+	case TRIGGERS_DISABLE:
+	default:
+		return nil, fmt.Errorf("unknown triggers mode %s", opts.Triggers)
+	}
+	// Los triggers se activan aunque se haya cancelado el contexto de la carga
+	restoreCtx := context.WithoutCancel(ctx)
+	disabled := []*pgutil.TableInfo{}
+	restore := func() error {
+		var firstErr error
+		for _, target := range disabled {
+			if _, err := dst.ExecContext(restoreCtx, enableTriggersQuery(target)); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("error enabling triggers of %s: %w", target.TableName(), err)
+			}
+		}
+		return firstErr
+	}
+	for _, table := range tables {
+		target := splitTableName(opts.targetName(table.TableName()))
+		if _, err := dst.ExecContext(ctx, disableTriggersQuery(target)); err != nil {
+			restore()
+			return nil, fmt.Errorf("error disabling triggers of %s: %w", target.TableName(), err)
+		}
+		log.Printf("triggers of %s disabled", target.TableName())
+		disabled = append(disabled, target)
+	}
+	return restore, nil
+}
+
+func disableTriggersQuery(table *pgutil.TableInfo) string {
+	return fmt.Sprintf("ALTER TABLE %s DISABLE TRIGGER USER", table.QuotedName())
+}
+
+func enableTriggersQuery(table *pgutil.TableInfo) string {
+	return fmt.Sprintf("ALTER TABLE %s ENABLE TRIGGER USER", table.QuotedName())
+}
@@ -0,0 +1,214 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/stellviaproject/dbmap/database"
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Retorna por tabla las columnas de las claves foráneas que aceptan nulos y referencian una tabla del mismo
+// nivel o de un nivel posterior: las referencias a la propia tabla y las que se ignoraron para romper un ciclo.
+// En la carga en dos fases esas columnas se copian en NULL y se completan cuando existen todas las filas
+func deferredKeys(levels [][]*pgutil.TableInfo) map[string][]string {
+	levelOf := map[string]int{}
+	for i, level := range levels {
+		for _, table := range level {
+			levelOf[table.TableName()] = i
+		}
+	}
+	deferred := map[string][]string{}
+	for i, level := range levels {
+		for _, table := range level {
+			for _, fk := range table.Constraints {
+				parentLevel, ok := levelOf[fk.ReferencedTable]
+				if !ok || parentLevel < i {
+					continue
+				}
+				if column := table.GetColumn(fk.Local); column == nil || !column.IsNullable {
+					continue
+				}
+				deferred[table.TableName()] = append(deferred[table.TableName()], fk.Local)
+			}
+		}
+	}
+	return deferred
+}
+
+// Lecturas del origen de la primera fase de la carga en dos fases, la segunda fase completa solo esas filas
+type phaseOne struct {
+	mu   sync.Mutex
+	read map[string]phaseOneRead    //Lectura de cada tabla copiada en la primera fase
+	kept map[string]map[string]bool //Claves de las filas que la política de conflictos dejó como estaban en el destino
+}
+
+// Lectura del origen de una tabla en la primera fase
+type phaseOneRead struct {
+	conditions []string //Condiciones de las filas leídas, con las del filtro y las de la marca de agua
+	empty      bool     //La copia incremental no tenía filas que leer
+}
+
+// Guarda la lectura de la tabla en la primera fase, si la carga es en dos fases
+func (opts *Options) recordRead(tableName string, read phaseOneRead) {
+	if opts == nil || opts.phaseOne == nil {
+		return
+	}
+	opts.phaseOne.mu.Lock()
+	defer opts.phaseOne.mu.Unlock()
+	opts.phaseOne.read[tableName] = read
+}
+
+// Guarda la clave de una fila del destino que la primera fase no escribió por la política de conflictos
+func (opts *Options) recordKept(tableName string, key []interface{}) {
+	if opts == nil || opts.phaseOne == nil {
+		return
+	}
+	opts.phaseOne.mu.Lock()
+	defer opts.phaseOne.mu.Unlock()
+	if opts.phaseOne.kept[tableName] == nil {
+		opts.phaseOne.kept[tableName] = map[string]bool{}
+	}
+	opts.phaseOne.kept[tableName][rowText(key)] = true
+}
+
+// Retorna true si la primera fase dejó sin escribir la fila del destino con la clave
+func (opts *Options) isKept(tableName string, key []interface{}) bool {
+	if opts == nil || opts.phaseOne == nil {
+		return false
+	}
+	opts.phaseOne.mu.Lock()
+	defer opts.phaseOne.mu.Unlock()
+	return opts.phaseOne.kept[tableName][rowText(key)]
+}
+
+// Retorna la lectura de la tabla en la primera fase, y false si la tabla no se leyó, ej. al reanudar una tabla completada
+func (opts *Options) phaseOneRead(tableName string) (phaseOneRead, bool) {
+	if opts == nil || opts.phaseOne == nil {
+		return phaseOneRead{}, false
+	}
+	opts.phaseOne.mu.Lock()
+	defer opts.phaseOne.mu.Unlock()
+	read, ok := opts.phaseOne.read[tableName]
+	return read, ok
+}
+
+// Segunda fase de la carga: completa las claves foráneas diferidas de las tablas, ya con todas las filas copiadas
+func backfillLevels(ctx context.Context, src *sql.DB, dst destination, levels [][]*pgutil.TableInfo, opts *Options) error {
+	for _, level := range levels {
+		for _, table := range level {
+			if len(opts.deferred[table.TableName()]) == 0 {
+				continue
+			}
+			log.Printf("backfill deferred foreign keys of %s", table.TableName())
+			ts, _, err := openTableSync(ctx, src, dst, table, opts)
+			if err != nil {
+				return err
+			}
+			if err := ts.backfill(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Vuelve a leer las filas del origen que leyó la primera fase y escribe en el destino los valores de las claves
+// foráneas diferidas. Las condiciones de la marca de agua se toman de la primera fase, que ya guardó la nueva marca
+func (ts *tableSync) backfill(ctx context.Context) error {
+	ts.backfilling = true
+	if read, ok := ts.opts.phaseOneRead(ts.table.TableName()); ok {
+		if read.empty {
+			return nil
+		}
+		ts.conditions = read.conditions
+	}
+	reader, closeReader, err := openReader(ctx, ts.src, ts.opts)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+	if ts.opts.Rows != nil {
+		return ts.syncKeys(ctx, reader, ts.opts.Rows[ts.table.TableName()])
+	}
+	return ts.syncRange(ctx, reader, 0, keyRange{}, "backfill")
+}
+
+// Retorna las claves foráneas de la tabla del destino que corresponden a las columnas diferidas
+func (ts *tableSync) deferredFKs() []pgutil.FKConstraintInfo {
+	fks := []pgutil.FKConstraintInfo{}
+	for _, local := range ts.opts.deferred[ts.table.TableName()] {
+		column, ok := ts.opts.targetColumn(ts.table.TableName(), local)
+		if !ok {
+			continue
+		}
+		for _, fk := range ts.mapping.target.Constraints {
+			if fk.Local == column {
+				fks = append(fks, fk)
+			}
+		}
+	}
+	return fks
+}
+
+// Escribe los valores de las claves foráneas diferidas del lote, con las columnas de la tabla del destino.
+// Solo se completan las columnas que siguen en NULL en el destino y cuya fila referenciada existe, y no se
+// tocan las filas que la política de conflictos dejó como estaban en el destino
+func (ts *tableSync) backfillBatch(ctx context.Context, batch [][]interface{}) error {
+	target := ts.mapping.target
+	columns := target.ColumnNames()
+	tx, err := ts.dst.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, fk := range ts.deferredFKs() {
+		stmt, err := tx.PrepareContext(ctx, backfillQuery(target, fk, ts.mapping.keys))
+		if err != nil {
+			return fmt.Errorf("error preparing backfill of %s: %w", fk.Name, err)
+		}
+		index := findColumnIndex(columns, fk.Local)
+		for _, values := range batch {
+			key := pickValues(values, ts.mapping.keyIndexes)
+			if values[index] == nil || ts.opts.isKept(ts.table.TableName(), key) {
+				continue
+			}
+			args := append([]interface{}{values[index]}, key...)
+			if _, err := stmt.ExecContext(ctx, args...); err != nil {
+				stmt.Close()
+				return fmt.Errorf("error backfilling %s: %w", fk.Name, err)
+			}
+		}
+		stmt.Close()
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// Retorna la query que pone el valor $1 en la columna de la clave foránea de la fila con la clave $2, $3,...
+// si la columna está en NULL y la fila referenciada existe
+func backfillQuery(table *pgutil.TableInfo, fk pgutil.FKConstraintInfo, keys []string) string {
+	local := database.QuoteIdent(fk.Local)
+	return fmt.Sprintf(
+		"UPDATE %s SET %s = $1 WHERE (%s) = (%s) AND %s IS NULL AND EXISTS (SELECT 1 FROM %s WHERE %s = $1)",
+		table.QuotedName(), local, database.QuoteIdentList(keys), keyPlaceholdersFrom(2, len(keys)), local,
+		database.QuoteTable(fk.ReferencedTable), database.QuoteIdent(fk.Referenced),
+	)
+}
+
+// Retorna $from, $from+1,... con count parametros
+func keyPlaceholdersFrom(from, count int) string {
+	placeholders := ""
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			placeholders += ", "
+		}
+		placeholders += fmt.Sprintf("$%d", from+i)
+	}
+	return placeholders
+}
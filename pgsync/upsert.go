@@ -0,0 +1,89 @@
+package pgsync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stellviaproject/dbmap/pgutil"
+)
+
+// Escribe el lote con INSERT ... VALUES ... ON CONFLICT (clave primaria) DO UPDATE, con tantas filas por
+// sentencia como permiten los parametros de postgres. Si nullMissing es true antes se ponen en NULL las
+// claves foráneas sin fila referenciada en el destino, consultando cada clave foránea una vez por lote
+func upsertBatch(ctx context.Context, dst destination, table *pgutil.TableInfo, batch [][]interface{}, nullMissing bool) error {
+	if nullMissing {
+		if err := nullMissingFKs(ctx, dst, table, batch); err != nil {
+			return err
+		}
+	}
+	tx, err := dst.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+	batch = dedupeKeys(table, batch)
+	size := keysPerQuery(len(table.Columns), len(batch))
+	for start := 0; start < len(batch); start += size {
+		rows := batch[start:min(start+size, len(batch))]
+		query, err := table.UpSertValuesQuery(len(rows))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, keyArgs(rows)...); err != nil {
+			return fmt.Errorf("error upserting records into %s: %w", table.TableName(), err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// Quita del lote las filas con una clave primaria repetida dejando la última, una sentencia ON CONFLICT no puede
+// actualizar la misma fila dos veces. Ocurre cuando una transformación que divide filas repite la clave
+func dedupeKeys(table *pgutil.TableInfo, batch [][]interface{}) [][]interface{} {
+	keyIndexes := columnIndexes(table.ColumnNames(), table.PrimaryKey())
+	last := map[string]int{}
+	for i, values := range batch {
+		last[rowText(pickValues(values, keyIndexes))] = i
+	}
+	if len(last) == len(batch) {
+		return batch
+	}
+	deduped := make([][]interface{}, 0, len(last))
+	for i, values := range batch {
+		if last[rowText(pickValues(values, keyIndexes))] == i {
+			deduped = append(deduped, values)
+		}
+	}
+	return deduped
+}
+
+// Pone en NULL los valores de las claves foráneas del lote cuya fila referenciada no existe en el destino,
+// si la referencia es a la misma tabla también se busca en el lote
+func nullMissingFKs(ctx context.Context, db reader, table *pgutil.TableInfo, batch [][]interface{}) error {
+	columns := table.ColumnNames()
+	for _, fk := range table.Constraints {
+		index := findColumnIndex(columns, fk.Local)
+		if index < 0 {
+			continue
+		}
+		found, err := existingValues(ctx, db, splitTableName(fk.ReferencedTable), fk.Referenced, batch, index)
+		if err != nil {
+			return err
+		}
+		if referenced := findColumnIndex(columns, fk.Referenced); fk.ReferencedTable == table.TableName() && referenced >= 0 {
+			for _, values := range batch {
+				if values[referenced] != nil {
+					found[valueText(values[referenced])] = true
+				}
+			}
+		}
+		for _, values := range batch {
+			if values[index] != nil && !found[valueText(values[index])] {
+				values[index] = nil
+			}
+		}
+	}
+	return nil
+}
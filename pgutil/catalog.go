@@ -0,0 +1,81 @@
+package pgutil
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Catalog obtiene el modelo de la estructura de una base de datos
+type Catalog interface {
+	// Retorna la información de todas las tablas de la base de datos
+	GetDataBaseInfo() (*DataBaseInfo, error)
+	// Recibe el nombre de la tabla en la forma scheme.table y devuelve la información de la tabla
+	GetTableInfo(tableName string) (*TableInfo, error)
+}
+
+// PgCatalog obtiene la estructura consultando una base de datos postgres
+type PgCatalog struct {
+	DB *sql.DB
+}
+
+func NewPgCatalog(db *sql.DB) *PgCatalog {
+	return &PgCatalog{DB: db}
+}
+
+func (pc *PgCatalog) GetDataBaseInfo() (*DataBaseInfo, error) {
+	return GetDataBaseInfo(pc.DB)
+}
+
+func (pc *PgCatalog) GetTableInfo(tableName string) (*TableInfo, error) {
+	return GetTableInfo(pc.DB, tableName)
+}
+
+// FixtureCatalog obtiene la estructura de un modelo en memoria, normalmente cargado de un archivo JSON
+type FixtureCatalog struct {
+	Info *DataBaseInfo
+}
+
+func NewFixtureCatalog(info *DataBaseInfo) *FixtureCatalog {
+	return &FixtureCatalog{Info: info}
+}
+
+// Carga el modelo desde un archivo JSON con el formato de DataBaseInfo
+func LoadFixtureCatalog(fileName string) (*FixtureCatalog, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading catalog fixture: %w", err)
+	}
+	return ParseFixtureCatalog(data)
+}
+
+// Crea el modelo desde el contenido JSON con el formato de DataBaseInfo
+func ParseFixtureCatalog(data []byte) (*FixtureCatalog, error) {
+	info := new(DataBaseInfo)
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("error parsing catalog fixture: %w", err)
+	}
+	return NewFixtureCatalog(info), nil
+}
+
+// Guarda el modelo en un archivo JSON que puede cargarse con LoadFixtureCatalog
+func (fc *FixtureCatalog) Save(fileName string) error {
+	data, err := json.MarshalIndent(fc.Info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding catalog fixture: %w", err)
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
+
+func (fc *FixtureCatalog) GetDataBaseInfo() (*DataBaseInfo, error) {
+	return fc.Info, nil
+}
+
+func (fc *FixtureCatalog) GetTableInfo(tableName string) (*TableInfo, error) {
+	table := fc.Info.GetTable(tableName)
+	if table == nil {
+		return nil, fmt.Errorf("error fetching table info: table %s not found in catalog", tableName)
+	}
+	return table, nil
+}
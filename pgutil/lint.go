@@ -0,0 +1,225 @@
+package pgutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Severity string //Severidad de un problema encontrado por el linter
+
+const (
+	SEVERITY_ERROR   Severity = "error"
+	SEVERITY_WARNING Severity = "warning"
+	SEVERITY_INFO    Severity = "info"
+)
+
+// Reglas del linter
+const (
+	RULE_NO_PRIMARY_KEY   = "no-primary-key"    //Tabla sin clave primaria
+	RULE_UNINDEXED_FK     = "unindexed-fk"      //Clave foranea sin indice que la soporte
+	RULE_NULLABLE_FK      = "nullable-fk"       //Clave foranea nula que la sincronizacion anula en silencio
+	RULE_FK_TYPE_MISMATCH = "fk-type-mismatch"  //Tipo de la clave foranea distinto al de la columna referenciada
+	RULE_UNREACHABLE      = "unreachable-table" //Tabla que ninguna configuracion alcanza
+	RULE_NAMING           = "naming"            //Nombre de tabla fuera de la convencion
+)
+
+// Severidades por defecto de cada regla
+var defaultSeverities = map[string]Severity{
+	RULE_NO_PRIMARY_KEY:   SEVERITY_ERROR,
+	RULE_UNINDEXED_FK:     SEVERITY_WARNING,
+	RULE_NULLABLE_FK:      SEVERITY_WARNING,
+	RULE_FK_TYPE_MISMATCH: SEVERITY_ERROR,
+	RULE_UNREACHABLE:      SEVERITY_INFO,
+	RULE_NAMING:           SEVERITY_WARNING,
+}
+
+// Esquemas del sistema que nunca se revisan
+var systemSchemes = []string{"pg_catalog", "information_schema", "pg_toast"}
+
+type LintConfig struct {
+	Disabled      []string            `json:"disabled,omitempty"`      //Reglas desactivadas
+	Severities    map[string]Severity `json:"severities,omitempty"`    //Severidad por regla, sustituye la severidad por defecto
+	Prefixes      []string            `json:"prefixes,omitempty"`      //Prefijos validos para los nombres de tablas, ej: tb_, nom_, r_
+	IgnoreSchemes []string            `json:"ignoreSchemes,omitempty"` //Esquemas que no se revisan ademas de los del sistema
+	Configs       [][]string          `json:"-"`                       //Listas de tablas de cada configuracion de copia
+}
+
+func (cfg *LintConfig) enabled(rule string) bool {
+	for _, disabled := range cfg.Disabled {
+		if disabled == rule {
+			return false
+		}
+	}
+	return true
+}
+
+func (cfg *LintConfig) severity(rule string) Severity {
+	if severity, ok := cfg.Severities[rule]; ok {
+		return severity
+	}
+	return defaultSeverities[rule]
+}
+
+func (cfg *LintConfig) ignored(table *TableInfo) bool {
+	for _, scheme := range systemSchemes {
+		if table.Scheme == scheme {
+			return true
+		}
+	}
+	for _, scheme := range cfg.IgnoreSchemes {
+		if table.Scheme == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+type LintIssue struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Table    string   `json:"table"`
+	Column   string   `json:"column,omitempty"`
+	Message  string   `json:"message"`
+}
+
+// Método String() para LintIssue
+func (li *LintIssue) String() string {
+	return fmt.Sprintf("[%s] %s %s: %s", li.Severity, li.Rule, li.Table, li.Message)
+}
+
+type LintReport struct {
+	Issues []LintIssue `json:"issues"`
+}
+
+// Retorna true si algun problema tiene severidad error
+func (lr *LintReport) HasErrors() bool {
+	for _, issue := range lr.Issues {
+		if issue.Severity == SEVERITY_ERROR {
+			return true
+		}
+	}
+	return false
+}
+
+// Retorna el reporte en formato JSON
+func (lr *LintReport) JSON() ([]byte, error) {
+	return json.MarshalIndent(lr, "", "  ")
+}
+
+// Método String() para LintReport
+func (lr *LintReport) String() string {
+	var sb strings.Builder
+	for _, issue := range lr.Issues {
+		sb.WriteString(issue.String())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// Revisa la estructura de la base de datos y reporta los problemas de diseño encontrados
+func Lint(info *DataBaseInfo, cfg *LintConfig) *LintReport {
+	if cfg == nil {
+		cfg = &LintConfig{}
+	}
+	report := &LintReport{Issues: []LintIssue{}}
+	add := func(rule string, table *TableInfo, column, message string) {
+		if !cfg.enabled(rule) {
+			return
+		}
+		report.Issues = append(report.Issues, LintIssue{
+			Rule:     rule,
+			Severity: cfg.severity(rule),
+			Table:    table.TableName(),
+			Column:   column,
+			Message:  message,
+		})
+	}
+	reachable := reachableTables(info, cfg.Configs)
+	for _, table := range info.Tables {
+		if cfg.ignored(table) {
+			continue
+		}
+		if len(table.PrimaryKey()) == 0 {
+			add(RULE_NO_PRIMARY_KEY, table, "", "la tabla no tiene clave primaria")
+		}
+		for _, fk := range table.Constraints {
+			column := table.GetColumn(fk.Local)
+			if column == nil {
+				continue
+			}
+			if !hasIndexFor(table, fk.Local) {
+				add(RULE_UNINDEXED_FK, table, fk.Local, fmt.Sprintf("la clave foranea %s no tiene un indice que la soporte", fk.Name))
+			}
+			if column.IsNullable {
+				add(RULE_NULLABLE_FK, table, fk.Local, fmt.Sprintf("la clave foranea %s acepta nulos, la copia la pondra en NULL si %s no contiene la fila referenciada", fk.Name, fk.ReferencedTable))
+			}
+			if referenced := info.GetTable(fk.ReferencedTable); referenced != nil {
+				if refColumn := referenced.GetColumn(fk.Referenced); refColumn != nil && !sameType(column, refColumn) {
+					add(RULE_FK_TYPE_MISMATCH, table, fk.Local, fmt.Sprintf("la columna es %s y la columna referenciada %s.%s es %s", column.TypeName(), fk.ReferencedTable, fk.Referenced, refColumn.TypeName()))
+				}
+			}
+		}
+		if reachable != nil && !reachable[table.TableName()] {
+			add(RULE_UNREACHABLE, table, "", "ninguna configuracion de copia incluye la tabla ni la referencia")
+		}
+		if len(cfg.Prefixes) > 0 && !hasPrefix(table.Name, cfg.Prefixes) {
+			add(RULE_NAMING, table, "", fmt.Sprintf("el nombre no comienza con ninguno de los prefijos %s", strings.Join(cfg.Prefixes, ", ")))
+		}
+	}
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		return report.Issues[i].Table < report.Issues[j].Table
+	})
+	return report
+}
+
+// Retorna true si algun indice de la tabla comienza por la columna
+func hasIndexFor(table *TableInfo, column string) bool {
+	for _, index := range table.Indexes {
+		if index.Covers(column) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameType(a, b *ColumnInfo) bool {
+	return a.DataType == b.DataType && a.LengthPrecision == b.LengthPrecision
+}
+
+func hasPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retorna las tablas incluidas en alguna configuracion junto con las tablas que estas referencian,
+// o nil si no hay configuraciones
+func reachableTables(info *DataBaseInfo, configs [][]string) map[string]bool {
+	if len(configs) == 0 {
+		return nil
+	}
+	reachable := map[string]bool{}
+	queue := []string{}
+	for _, tables := range configs {
+		queue = append(queue, tables...)
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if reachable[current] {
+			continue
+		}
+		reachable[current] = true
+		if table := info.GetTable(current); table != nil {
+			for _, fk := range table.Constraints {
+				queue = append(queue, fk.ReferencedTable)
+			}
+		}
+	}
+	return reachable
+}
@@ -1,6 +1,9 @@
 package pgutil
 
 import (
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stellviaproject/dbmap/database"
@@ -49,3 +52,290 @@ func TestGetDefinition(t *testing.T) {
 	}
 	t.Log(query)
 }
+
+func TestLint(t *testing.T) {
+	info := &DataBaseInfo{Tables: []*TableInfo{
+		{
+			Scheme: "pkt_encoders",
+			Name:   "nom_gender",
+			Columns: []ColumnInfo{
+				{Name: "id", DataType: "integer", IsPrimaryKey: true},
+			},
+		},
+		{
+			Scheme: "pkt_organization",
+			Name:   "student",
+			Columns: []ColumnInfo{
+				{Name: "id", DataType: "integer"},
+				{Name: "gender_id", DataType: "bigint", IsNullable: true},
+			},
+			Constraints: []FKConstraintInfo{
+				{Name: "fk_student_gender", Local: "gender_id", Referenced: "id", ReferencedTable: "pkt_encoders.nom_gender"},
+			},
+		},
+		{
+			Scheme: "pkt_organization",
+			Name:   "tb_log",
+			Columns: []ColumnInfo{
+				{Name: "id", DataType: "integer", IsPrimaryKey: true},
+			},
+		},
+	}}
+	report := Lint(info, &LintConfig{
+		Prefixes: []string{"tb_", "nom_", "r_"},
+		Configs:  [][]string{{"pkt_organization.student"}},
+	})
+	expected := map[string]string{
+		RULE_NO_PRIMARY_KEY:   "pkt_organization.student",
+		RULE_UNINDEXED_FK:     "pkt_organization.student",
+		RULE_NULLABLE_FK:      "pkt_organization.student",
+		RULE_FK_TYPE_MISMATCH: "pkt_organization.student",
+		RULE_NAMING:           "pkt_organization.student",
+		RULE_UNREACHABLE:      "pkt_organization.tb_log",
+	}
+	if len(report.Issues) != len(expected) {
+		t.Fatalf("se esperaban %d problemas y se encontraron %d:\n%s", len(expected), len(report.Issues), report.String())
+	}
+	for _, issue := range report.Issues {
+		if expected[issue.Rule] != issue.Table {
+			t.Errorf("problema inesperado: %s", issue.String())
+		}
+	}
+	if !report.HasErrors() {
+		t.Error("el reporte deberia tener errores")
+	}
+
+	report = Lint(info, &LintConfig{Disabled: []string{RULE_NO_PRIMARY_KEY, RULE_FK_TYPE_MISMATCH}})
+	if report.HasErrors() {
+		t.Errorf("no se esperaban errores con las reglas desactivadas:\n%s", report.String())
+	}
+}
+
+func TestFixtureCatalog(t *testing.T) {
+	info := &DataBaseInfo{Tables: []*TableInfo{
+		{
+			Scheme:  "pkt_encoders",
+			Name:    "nom_gender",
+			Columns: []ColumnInfo{{Name: "id", DataType: "integer", IsPrimaryKey: true}},
+			Indexes: []IndexInfo{{Name: "nom_gender_pkey", Columns: []string{"id"}, IsUnique: true, IsPrimary: true}},
+		},
+	}}
+	fileName := filepath.Join(t.TempDir(), "catalog.json")
+	if err := NewFixtureCatalog(info).Save(fileName); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := LoadFixtureCatalog(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := catalog.GetTableInfo("pkt_encoders.nom_gender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.String() != info.Tables[0].String() {
+		t.Fatalf("la tabla cargada no coincide:\n%s\n%s", table.String(), info.Tables[0].String())
+	}
+	if _, err := catalog.GetTableInfo("pkt_encoders.nom_career"); err == nil {
+		t.Fatal("se esperaba un error para una tabla inexistente")
+	}
+}
+
+func TestQuotedQueries(t *testing.T) {
+	table := &TableInfo{
+		Scheme: "Public",
+		Name:   "order",
+		Columns: []ColumnInfo{
+			{Name: "id", DataType: "integer", IsPrimaryKey: true},
+			{Name: "user", DataType: "text"},
+			{Name: `first "name"`, DataType: "text"},
+		},
+	}
+	expected := [][2]string{
+		{table.CountQuery(), `SELECT COUNT(*) FROM "Public"."order"`},
+		{table.SelectQuery(), `SELECT "id", "user", "first ""name""" FROM "Public"."order"`},
+		{table.SelectExistsQuery(), `SELECT EXISTS (SELECT 1 FROM "Public"."order" WHERE "id" = $1)`},
+		{table.SelectExistingValuesQuery("user", 2, "active"), `SELECT DISTINCT "user" FROM "Public"."order" WHERE "user" IN ($1, $2) AND (active)`},
+		{table.InsertQuery(), `INSERT INTO "Public"."order" ("id", "user", "first ""name""") VALUES ($1, $2, $3)`},
+		{table.UpdateQuery(), `UPDATE "Public"."order" SET "id" = $1, "user" = $2, "first ""name""" = $3 WHERE "id" = $4`},
+		{table.UpSertQuery("bk.order"), `INSERT INTO "bk"."order" ("id", "user", "first ""name""") SELECT "id", "user", "first ""name""" FROM "Public"."order" ON CONFLICT ("id") DO UPDATE SET "id" = EXCLUDED."id", "user" = EXCLUDED."user", "first ""name""" = EXCLUDED."first ""name""";`},
+	}
+	for _, queries := range expected {
+		if query, want := queries[0], queries[1]; query != want {
+			t.Errorf("consulta inesperada:\n got: %s\nwant: %s", query, want)
+		}
+	}
+}
+
+func TestUpSertValuesQuery(t *testing.T) {
+	table := &TableInfo{
+		Scheme: "Public",
+		Name:   "order",
+		Columns: []ColumnInfo{
+			{Name: "id", DataType: "integer", IsPrimaryKey: true},
+			{Name: "user", DataType: "text"},
+			{Name: `first "name"`, DataType: "text"},
+		},
+	}
+	single := &TableInfo{Scheme: "Public", Name: "tag", Columns: []ColumnInfo{{Name: "id", DataType: "integer", IsPrimaryKey: true}}}
+	expected := map[*TableInfo]string{
+		table:  `INSERT INTO "Public"."order" ("id", "user", "first ""name""") VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT ("id") DO UPDATE SET "id" = EXCLUDED."id", "user" = EXCLUDED."user", "first ""name""" = EXCLUDED."first ""name"""`,
+		single: `INSERT INTO "Public"."tag" ("id") VALUES ($1), ($2) ON CONFLICT ("id") DO UPDATE SET "id" = EXCLUDED."id"`,
+	}
+	for tb, want := range expected {
+		query, err := tb.UpSertValuesQuery(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != want {
+			t.Errorf("consulta inesperada:\n got: %s\nwant: %s", query, want)
+		}
+	}
+	// Sin clave primaria no hay ON CONFLICT posible
+	noKey := &TableInfo{Scheme: "public", Name: "log", Columns: []ColumnInfo{{Name: "line", DataType: "text"}}}
+	if _, err := noKey.UpSertValuesQuery(1); err == nil {
+		t.Error("se esperaba error sin clave primaria")
+	}
+}
+
+func TestKeysetQuery(t *testing.T) {
+	table := &TableInfo{
+		Scheme: "pkt_organization",
+		Name:   "r_career_application",
+		Columns: []ColumnInfo{
+			{Name: "career_id", DataType: "integer"},
+			{Name: "application_id", DataType: "integer"},
+			{Name: "priority", DataType: "integer", IsNullable: true},
+		},
+		Indexes: []IndexInfo{
+			{Name: "ix_priority", Columns: []string{"priority"}, IsUnique: true},
+			{Name: "ux_career_application", Columns: []string{"career_id", "application_id"}, IsUnique: true},
+		},
+	}
+	keys := table.UniqueKey()
+	if strings.Join(keys, ",") != "career_id,application_id" {
+		t.Fatalf("clave inesperada: %v", keys)
+	}
+	first := table.SelectWithKeysetQuery(keys, 100, false)
+	want := `SELECT "career_id", "application_id", "priority" FROM "pkt_organization"."r_career_application" ORDER BY "career_id", "application_id" LIMIT 100`
+	if first != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", first, want)
+	}
+	next := table.SelectWithKeysetQuery(keys, 100, true)
+	want = `SELECT "career_id", "application_id", "priority" FROM "pkt_organization"."r_career_application" WHERE ("career_id", "application_id") > ($1, $2) ORDER BY "career_id", "application_id" LIMIT 100`
+	if next != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", next, want)
+	}
+	chunk := table.SelectKeyRangeQuery(keys, 100, false, true, true)
+	want = `SELECT "career_id", "application_id", "priority" FROM "pkt_organization"."r_career_application" WHERE ("career_id", "application_id") >= ($1, $2) AND ("career_id", "application_id") < ($3, $4) ORDER BY "career_id", "application_id" LIMIT 100`
+	if chunk != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", chunk, want)
+	}
+	copyQuery := table.CopyKeyRangeQuery(keys, []string{"3", "it's"}, []string{"9", "1"}, true, "priority > 0")
+	want = `COPY (SELECT "career_id", "application_id", "priority" FROM "pkt_organization"."r_career_application" WHERE ("career_id", "application_id") > ('3', 'it''s') AND ("career_id", "application_id") < ('9', '1') AND (priority > 0) ORDER BY "career_id", "application_id") TO STDOUT`
+	if copyQuery != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", copyQuery, want)
+	}
+	if copyAll := table.CopyKeyRangeQuery(keys, nil, nil, false); strings.Contains(copyAll, "WHERE") {
+		t.Errorf("consulta inesperada: %s", copyAll)
+	}
+	byKeys := table.SelectByKeysQuery(keys, 2)
+	want = `SELECT "career_id", "application_id", "priority" FROM "pkt_organization"."r_career_application" WHERE ("career_id", "application_id") IN (($1, $2), ($3, $4))`
+	if byKeys != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", byKeys, want)
+	}
+	keysOnly := table.SelectKeysQuery(keys, 100, true)
+	want = `SELECT "career_id", "application_id" FROM "pkt_organization"."r_career_application" WHERE ("career_id", "application_id") > ($1, $2) ORDER BY "career_id", "application_id" LIMIT 100`
+	if keysOnly != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", keysOnly, want)
+	}
+	deleteQuery := table.DeleteByKeysQuery(keys, 2)
+	want = `DELETE FROM "pkt_organization"."r_career_application" WHERE ("career_id", "application_id") IN (($1, $2), ($3, $4))`
+	if deleteQuery != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", deleteQuery, want)
+	}
+}
+
+// Correr con -race: las partes de una tabla se leen a la vez con las consultas guardadas en la misma TableInfo
+func TestConcurrentQueries(t *testing.T) {
+	table := &TableInfo{
+		Scheme: "public",
+		Name:   "order",
+		Columns: []ColumnInfo{
+			{Name: "id", DataType: "integer", IsPrimaryKey: true},
+			{Name: "user", DataType: "text"},
+		},
+	}
+	table.CacheQueries()
+	want := table.SelectKeyRangeQuery([]string{"id"}, 100, true, false, true)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if query := table.SelectKeyRangeQuery([]string{"id"}, 100, true, false, true); query != want {
+				t.Errorf("consulta inesperada: %s", query)
+			}
+			table.SelectByKeysQuery([]string{"id"}, 2)
+			table.SelectExistsQuery()
+			table.InsertQuery()
+			table.UpdateQuery()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCreateQueries(t *testing.T) {
+	table := &TableInfo{
+		Scheme: "pkt_organization",
+		Name:   "tb_student",
+		Columns: []ColumnInfo{
+			{Name: "id", DataType: "integer", IsPrimaryKey: true},
+			{Name: "name", DataType: "character varying", LengthPrecision: 100},
+			{Name: "gender_id", DataType: "integer", IsNullable: true},
+		},
+	}
+	create, err := table.CreateTableQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := IndexInfo{Name: "ix_student_gender", Columns: []string{"gender_id"}, Definition: "CREATE INDEX ix_student_gender ON pkt_organization.tb_student USING btree (gender_id)"}
+	unique := IndexInfo{Name: "ux_student_name", Columns: []string{"name"}, IsUnique: true, Definition: "CREATE UNIQUE INDEX ux_student_name ON pkt_organization.tb_student USING btree (name)"}
+	fk := FKConstraintInfo{Name: "fk_student_gender", Local: "gender_id", Referenced: "id", ReferencedTable: "pkt_encoders.nom_gender", OnUpdate: NO_ACTION, OnDelete: SET_NULL}
+	expected := [][2]string{
+		{table.CreateSchemaQuery(), `CREATE SCHEMA IF NOT EXISTS "pkt_organization"`},
+		{create, `CREATE TABLE IF NOT EXISTS "pkt_organization"."tb_student" ("id" integer NOT NULL, "name" character varying(100) NOT NULL, "gender_id" integer, PRIMARY KEY ("id"))`},
+		{index.CreateQuery(), `CREATE INDEX IF NOT EXISTS ix_student_gender ON pkt_organization.tb_student USING btree (gender_id)`},
+		{unique.CreateQuery(), `CREATE UNIQUE INDEX IF NOT EXISTS ux_student_name ON pkt_organization.tb_student USING btree (name)`},
+		{table.CreateIndexQuery(unique, []string{"full_name"}), `CREATE UNIQUE INDEX IF NOT EXISTS "ux_student_name" ON "pkt_organization"."tb_student" ("full_name")`},
+		{table.AddForeignKeyQuery(fk), `ALTER TABLE "pkt_organization"."tb_student" ADD CONSTRAINT "fk_student_gender" FOREIGN KEY ("gender_id") REFERENCES "pkt_encoders"."nom_gender" ("id") ON UPDATE NO ACTION ON DELETE SET NULL`},
+	}
+	for _, queries := range expected {
+		if query, want := queries[0], queries[1]; query != want {
+			t.Errorf("consulta inesperada:\n got: %s\nwant: %s", query, want)
+		}
+	}
+	table.Columns = append(table.Columns, ColumnInfo{Name: "tags", DataType: "ARRAY", IsNullable: true})
+	if _, err := table.CreateTableQuery(); err == nil {
+		t.Error("se esperaba un error por una columna ARRAY")
+	}
+
+	//Con el tipo completo del catálogo se conservan la precisión, los valores por defecto, serial e identity
+	invoice := &TableInfo{
+		Scheme: "public",
+		Name:   "invoice",
+		Columns: []ColumnInfo{
+			{Name: "id", DataType: "integer", IsPrimaryKey: true, Type: "integer", Default: "nextval('invoice_id_seq'::regclass)"},
+			{Name: "number", DataType: "bigint", Type: "bigint", Identity: "ALWAYS"},
+			{Name: "total", DataType: "numeric", Type: "numeric(10,2)", Default: "0"},
+			{Name: "tags", DataType: "ARRAY", Type: "text[]", IsNullable: true},
+		},
+	}
+	create, err = invoice.CreateTableQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `CREATE TABLE IF NOT EXISTS "public"."invoice" ("id" serial NOT NULL, "number" bigint GENERATED BY DEFAULT AS IDENTITY NOT NULL, "total" numeric(10,2) DEFAULT 0 NOT NULL, "tags" text[], PRIMARY KEY ("id"))`
+	if create != want {
+		t.Errorf("consulta inesperada:\n got: %s\nwant: %s", create, want)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"strings"
+
+	"github.com/stellviaproject/dbmap/database"
 )
 
 func MakeSave(db *sql.DB) error {
@@ -32,7 +34,7 @@ func MakeSave(db *sql.DB) error {
 			newTableName := fmt.Sprintf("%s_save", tableName)
 
 			// Renombrar la tabla
-			_, err := db.Exec(fmt.Sprintf(`ALTER TABLE "%s"."%s" RENAME TO "%s";`, schemaName, tableName, newTableName))
+			_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s.%s RENAME TO %s;`, database.QuoteIdent(schemaName), database.QuoteIdent(tableName), database.QuoteIdent(newTableName)))
 			if err != nil {
 				return fmt.Errorf("error al renombrar la tabla %s.%s a %s: %v", schemaName, tableName, newTableName, err)
 			}
@@ -75,7 +77,7 @@ func UnMakeSave(db *sql.DB) error {
 			newTableName := strings.TrimSuffix(tableName, "_save")
 
 			// Renombrar la tabla
-			_, err := db.Exec(fmt.Sprintf(`ALTER TABLE "%s"."%s" RENAME TO "%s";`, schemaName, tableName, newTableName))
+			_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s.%s RENAME TO %s;`, database.QuoteIdent(schemaName), database.QuoteIdent(tableName), database.QuoteIdent(newTableName)))
 			if err != nil {
 				return fmt.Errorf("error al renombrar la tabla %s.%s a %s: %v", schemaName, tableName, newTableName, err)
 			}
@@ -160,7 +162,7 @@ func DropNotSave(db *sql.DB) error {
 		}
 
 		// Formatear el nombre completo como <scheme>.<table>
-		fullTableName := fmt.Sprintf(`"%s"."%s"`, schemaName, tableName)
+		fullTableName := fmt.Sprintf(`%s.%s`, database.QuoteIdent(schemaName), database.QuoteIdent(tableName))
 		tablesToDelete = append(tablesToDelete, fullTableName)
 	}
 
@@ -207,7 +209,7 @@ func CleanTables(db *sql.DB) error {
 		}
 
 		// Construir la consulta DELETE para limpiar la tabla
-		fullTableName := fmt.Sprintf(`"%s"."%s"`, schemaName, tableName)
+		fullTableName := fmt.Sprintf(`%s.%s`, database.QuoteIdent(schemaName), database.QuoteIdent(tableName))
 		deleteQuery := fmt.Sprintf("DELETE FROM %s;", fullTableName)
 
 		fmt.Printf("Limpiando datos de la tabla: %s\n", fullTableName)
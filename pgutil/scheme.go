@@ -4,6 +4,9 @@ import (
 	"database/sql"
 	"fmt"
 	"strings"
+
+	"github.com/lib/pq"
+	"github.com/stellviaproject/dbmap/database"
 )
 
 type DataBaseInfo struct {
@@ -21,11 +24,22 @@ func (db *DataBaseInfo) String() string {
 	return sb.String()
 }
 
+// Retorna la tabla con el nombre en la forma scheme.table o nil si no existe
+func (db *DataBaseInfo) GetTable(tableName string) *TableInfo {
+	for _, table := range db.Tables {
+		if table.TableName() == tableName {
+			return table
+		}
+	}
+	return nil
+}
+
 type TableInfo struct {
 	Scheme             string       //Esquema de la tabla
 	Name               string       //Nombre de la tabla
 	Columns            []ColumnInfo //Columnas de la tabla
 	Constraints        []FKConstraintInfo
+	Indexes            []IndexInfo //Indices de la tabla
 	selectQuery        string
 	insertQuery        string
 	selectExistsQuery  string
@@ -37,6 +51,20 @@ func (tb *TableInfo) TableName() string {
 	return fmt.Sprintf("%s.%s", tb.Scheme, tb.Name)
 }
 
+// Retorna el nombre de la tabla listo para usar en una consulta SQL, en la forma "scheme"."table"
+func (tb *TableInfo) QuotedName() string {
+	return database.QuoteIdent(tb.Scheme) + "." + database.QuoteIdent(tb.Name)
+}
+
+// Retorna los nombres de todas las columnas
+func (tb *TableInfo) ColumnNames() []string {
+	columnNames := []string{}
+	for _, column := range tb.Columns {
+		columnNames = append(columnNames, column.Name)
+	}
+	return columnNames
+}
+
 func (tb *TableInfo) GetColumn(columnName string) *ColumnInfo {
 	for _, column := range tb.Columns {
 		if column.Name == columnName {
@@ -46,8 +74,53 @@ func (tb *TableInfo) GetColumn(columnName string) *ColumnInfo {
 	return nil
 }
 
+// Retorna los nombres de las columnas de la clave primaria
+func (tb *TableInfo) PrimaryKey() []string {
+	primaryKeys := []string{}
+	for _, column := range tb.Columns {
+		if column.IsPrimaryKey {
+			primaryKeys = append(primaryKeys, column.Name)
+		}
+	}
+	return primaryKeys
+}
+
 func (tb *TableInfo) CountQuery() string {
-	return fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", tb.Scheme, tb.Name)
+	return fmt.Sprintf("SELECT COUNT(*) FROM %s", tb.QuotedName())
+}
+
+// Igual que CountQuery pero cuenta solo las filas que cumplen todas las condiciones SQL dadas
+func (tb *TableInfo) CountWhereQuery(conditions ...string) string {
+	return tb.CountQuery() + whereClause(conditions)
+}
+
+// Retorna una query que obtiene como texto el mayor valor de la columna entre las filas que cumplen las condiciones
+func (tb *TableInfo) MaxQuery(column string, conditions ...string) string {
+	return fmt.Sprintf("SELECT MAX(%s)::text FROM %s%s", database.QuoteIdent(column), tb.QuotedName(), whereClause(conditions))
+}
+
+// Retorna " WHERE (c1) AND (c2)..." o vacío si no hay condiciones
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	wrapped := make([]string, len(conditions))
+	for i, condition := range conditions {
+		wrapped[i] = "(" + condition + ")"
+	}
+	return " WHERE " + strings.Join(wrapped, " AND ")
+}
+
+// Construye las consultas que la tabla guarda para reutilizarlas. Se guardan sin sincronización la primera vez
+// que se piden, una tabla que se consulta desde varias goroutines debe llamar antes a CacheQueries
+func (tb *TableInfo) CacheQueries() {
+	tb.SelectQuery()
+	tb.SelectExistsQuery()
+	tb.InsertQuery()
+	tb.UpdateQuery()
+	if tb.selectBatchColumns == "" {
+		tb.selectBatchColumns = database.QuoteIdentList(tb.ColumnNames())
+	}
 }
 
 func (tb *TableInfo) SelectExistsQuery() string {
@@ -56,13 +129,13 @@ func (tb *TableInfo) SelectExistsQuery() string {
 		whereClauses := []string{}
 		for _, column := range tb.Columns {
 			if column.IsPrimaryKey {
-				whereClauses = append(whereClauses, fmt.Sprintf("%s = $%d", column.Name, len(whereClauses)+1))
+				whereClauses = append(whereClauses, fmt.Sprintf("%s = $%d", database.QuoteIdent(column.Name), len(whereClauses)+1))
 			}
 		}
 		whereClause := strings.Join(whereClauses, " AND ")
 
 		// Construir la consulta SELECT EXISTS
-		tb.selectExistsQuery = fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s.%s WHERE %s)", tb.Scheme, tb.Name, whereClause)
+		tb.selectExistsQuery = fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE %s)", tb.QuotedName(), whereClause)
 	}
 	return tb.selectExistsQuery
 }
@@ -70,12 +143,8 @@ func (tb *TableInfo) SelectExistsQuery() string {
 // Retorna una query SELECT column1, column2, colum3,... FROM table
 func (tb *TableInfo) SelectQuery() string {
 	if tb.selectQuery == "" {
-		columnNames := []string{}
-		for _, column := range tb.Columns {
-			columnNames = append(columnNames, column.Name)
-		}
-		columns := strings.Join(columnNames, ", ")
-		tb.selectQuery = fmt.Sprintf("SELECT %s FROM %s.%s", columns, tb.Scheme, tb.Name)
+		columns := database.QuoteIdentList(tb.ColumnNames())
+		tb.selectQuery = fmt.Sprintf("SELECT %s FROM %s", columns, tb.QuotedName())
 	}
 	return tb.selectQuery
 }
@@ -83,17 +152,185 @@ func (tb *TableInfo) SelectQuery() string {
 // Retorna una query SELECT column1, column2, column3,... FROM table con soporte para batch (LIMIT y OFFSET)
 func (tb *TableInfo) SelectWithBatchQuery(limit, offset int) string {
 	if tb.selectBatchColumns == "" {
-		columnNames := []string{}
-		for _, column := range tb.Columns {
-			columnNames = append(columnNames, column.Name)
+		tb.selectBatchColumns = database.QuoteIdentList(tb.ColumnNames())
+	}
+	return fmt.Sprintf("SELECT %s FROM %s LIMIT %d OFFSET %d", tb.selectBatchColumns, tb.QuotedName(), limit, offset)
+}
+
+// Retorna una query SELECT column1, column2,... FROM table paginada por las columnas de la clave (keyset):
+// WHERE (key1, key2) > ($1, $2) ORDER BY key1, key2 LIMIT n, los parametros son los valores de la clave de la ultima fila del lote anterior.
+// Con after en false retorna el primer lote, sin WHERE
+func (tb *TableInfo) SelectWithKeysetQuery(keys []string, limit int, after bool) string {
+	return tb.SelectKeyRangeQuery(keys, limit, after, false, false)
+}
+
+// Igual que SelectWithKeysetQuery pero limitada a un rango de claves. El limite inferior es la clave de la
+// ultima fila leida si after es true (>), o el inicio del rango si from es true (>=); el limite superior es
+// el final del rango si to es true (<). Los parametros son primero el limite inferior y luego el superior.
+// Las condiciones SQL adicionales se agregan al WHERE y no pueden usar parametros
+func (tb *TableInfo) SelectKeyRangeQuery(keys []string, limit int, after, from, to bool, conditions ...string) string {
+	if tb.selectBatchColumns == "" {
+		tb.selectBatchColumns = database.QuoteIdentList(tb.ColumnNames())
+	}
+	keyColumns := database.QuoteIdentList(keys)
+	placeholder := 1
+	params := func() string {
+		placeholders := []string{}
+		for range keys {
+			placeholders = append(placeholders, fmt.Sprintf("$%d", placeholder))
+			placeholder++
 		}
-		tb.selectBatchColumns = strings.Join(columnNames, ", ")
+		return strings.Join(placeholders, ", ")
 	}
-	return fmt.Sprintf("SELECT %s FROM %s.%s LIMIT %d OFFSET %d", tb.selectBatchColumns, tb.Scheme, tb.Name, limit, offset)
+	lower, upper := "", ""
+	if after || from {
+		lower = params()
+	}
+	if to {
+		upper = params()
+	}
+	where := keyRangeWhere(keyColumns, lower, upper, after, conditions)
+	return fmt.Sprintf("SELECT %s FROM %s%s ORDER BY %s LIMIT %d", tb.selectBatchColumns, tb.QuotedName(), where, keyColumns, limit)
+}
+
+// Igual que SelectKeyRangeQuery sin LIMIT dentro de COPY (...) TO STDOUT, que lee todo el rango en una sola consulta.
+// COPY no acepta parametros, los limites son los textos de los valores de la clave y se escriben como literales;
+// lower es nil si el rango no tiene limite inferior y upper si no tiene limite superior
+func (tb *TableInfo) CopyKeyRangeQuery(keys []string, lower, upper []string, after bool, conditions ...string) string {
+	if tb.selectBatchColumns == "" {
+		tb.selectBatchColumns = database.QuoteIdentList(tb.ColumnNames())
+	}
+	keyColumns := database.QuoteIdentList(keys)
+	literals := func(values []string) string {
+		quoted := make([]string, len(values))
+		for i, value := range values {
+			quoted[i] = pq.QuoteLiteral(value)
+		}
+		return strings.Join(quoted, ", ")
+	}
+	where := keyRangeWhere(keyColumns, literals(lower), literals(upper), after, conditions)
+	return fmt.Sprintf("COPY (SELECT %s FROM %s%s ORDER BY %s) TO STDOUT", tb.selectBatchColumns, tb.QuotedName(), where, keyColumns)
 }
 
-// Retorna INSERT INTO %s.%s VALUES ($1,$2,...)
-// Los values con la misma cantidad que el numero de columnas
+// Retorna el WHERE de un rango de claves: mayor (after) o mayor o igual que lower y menor que upper, los limites
+// vacios no se agregan. Las condiciones SQL adicionales van despues de las del rango
+func keyRangeWhere(keyColumns, lower, upper string, after bool, conditions []string) string {
+	keyConditions := []string{}
+	if lower != "" && after {
+		keyConditions = append(keyConditions, fmt.Sprintf("(%s) > (%s)", keyColumns, lower))
+	} else if lower != "" {
+		keyConditions = append(keyConditions, fmt.Sprintf("(%s) >= (%s)", keyColumns, lower))
+	}
+	if upper != "" {
+		keyConditions = append(keyConditions, fmt.Sprintf("(%s) < (%s)", keyColumns, upper))
+	}
+	for _, condition := range conditions {
+		keyConditions = append(keyConditions, "("+condition+")")
+	}
+	if len(keyConditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(keyConditions, " AND ")
+}
+
+// Retorna una query que lee una muestra de las claves de la tabla ordenadas, con el porcentaje de paginas dado
+func (tb *TableInfo) SampleKeysQuery(keys []string, percent float64) string {
+	keyColumns := database.QuoteIdentList(keys)
+	return fmt.Sprintf("SELECT %s FROM %s TABLESAMPLE SYSTEM (%g) ORDER BY %s", keyColumns, tb.QuotedName(), percent, keyColumns)
+}
+
+// Retorna una query SELECT column1, column2,... FROM table de las filas cuyas claves están en la lista:
+// WHERE (key1, key2) IN (($1, $2), ($3, $4), ...), con count claves como parametros.
+// Las condiciones SQL adicionales se agregan al WHERE y no pueden usar parametros
+func (tb *TableInfo) SelectByKeysQuery(keys []string, count int, conditions ...string) string {
+	if tb.selectBatchColumns == "" {
+		tb.selectBatchColumns = database.QuoteIdentList(tb.ColumnNames())
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE (%s) IN (%s)", tb.selectBatchColumns, tb.QuotedName(), database.QuoteIdentList(keys), KeyPlaceholders(len(keys), count))
+	for _, condition := range conditions {
+		query += " AND (" + condition + ")"
+	}
+	return query
+}
+
+// Retorna una query que obtiene los valores distintos de la columna que están en una lista de count parametros,
+// entre las filas que cumplen las condiciones SQL dadas
+func (tb *TableInfo) SelectExistingValuesQuery(column string, count int, conditions ...string) string {
+	quoted := database.QuoteIdent(column)
+	query := fmt.Sprintf("SELECT DISTINCT %s FROM %s WHERE %s IN (%s)", quoted, tb.QuotedName(), quoted, KeyPlaceholders(1, count))
+	for _, condition := range conditions {
+		query += " AND (" + condition + ")"
+	}
+	return query
+}
+
+// Retorna una query que lee solo las columnas de la clave, paginada igual que SelectWithKeysetQuery
+func (tb *TableInfo) SelectKeysQuery(keys []string, limit int, after bool) string {
+	keyColumns := database.QuoteIdentList(keys)
+	where := ""
+	if after {
+		where = fmt.Sprintf(" WHERE (%s) > (%s)", keyColumns, KeyPlaceholders(1, len(keys)))
+	}
+	return fmt.Sprintf("SELECT %s FROM %s%s ORDER BY %s LIMIT %d", keyColumns, tb.QuotedName(), where, keyColumns, limit)
+}
+
+// Retorna una query que obtiene cuáles de las count claves de la lista existen en la tabla entre las filas
+// que cumplen las condiciones SQL dadas
+func (tb *TableInfo) SelectExistingKeysQuery(keys []string, count int, conditions ...string) string {
+	keyColumns := database.QuoteIdentList(keys)
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE (%s) IN (%s)", keyColumns, tb.QuotedName(), keyColumns, KeyPlaceholders(len(keys), count))
+	for _, condition := range conditions {
+		query += " AND (" + condition + ")"
+	}
+	return query
+}
+
+// Retorna una query DELETE de las filas cuyas claves están en una lista de count claves
+func (tb *TableInfo) DeleteByKeysQuery(keys []string, count int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE (%s) IN (%s)", tb.QuotedName(), database.QuoteIdentList(keys), KeyPlaceholders(len(keys), count))
+}
+
+// Retorna ($1, $2), ($3, $4),... para count claves de size columnas, con una sola columna retorna $1, $2,...
+func KeyPlaceholders(size, count int) string {
+	tuples := make([]string, count)
+	for i := range tuples {
+		placeholders := make([]string, size)
+		for j := range placeholders {
+			placeholders[j] = fmt.Sprintf("$%d", i*size+j+1)
+		}
+		if size == 1 {
+			tuples[i] = placeholders[0]
+		} else {
+			tuples[i] = "(" + strings.Join(placeholders, ", ") + ")"
+		}
+	}
+	return strings.Join(tuples, ", ")
+}
+
+// Retorna las columnas que identifican una fila: la clave primaria o, si no tiene,
+// el primer indice unico con todas sus columnas no nulas. Retorna nil si no hay ninguna
+func (tb *TableInfo) UniqueKey() []string {
+	if primaryKeys := tb.PrimaryKey(); len(primaryKeys) > 0 {
+		return primaryKeys
+	}
+	for _, index := range tb.Indexes {
+		if !index.IsUnique || len(index.Columns) == 0 {
+			continue
+		}
+		notNull := true
+		for _, columnName := range index.Columns {
+			if column := tb.GetColumn(columnName); column == nil || column.IsNullable {
+				notNull = false
+			}
+		}
+		if notNull {
+			return index.Columns
+		}
+	}
+	return nil
+}
+
+// Retorna una query insert con la lista de columnas, las columnas de la tabla destino que no están en la lista toman su valor por defecto
 func (tb *TableInfo) InsertQuery() string {
 	if tb.insertQuery == "" {
 		valuePlaceholders := []string{}
@@ -101,18 +338,18 @@ func (tb *TableInfo) InsertQuery() string {
 			valuePlaceholders = append(valuePlaceholders, fmt.Sprintf("$%d", i+1))
 		}
 		values := strings.Join(valuePlaceholders, ", ")
-		tb.insertQuery = fmt.Sprintf("INSERT INTO %s.%s VALUES (%s)", tb.Scheme, tb.Name, values)
+		tb.insertQuery = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", tb.QuotedName(), database.QuoteIdentList(tb.ColumnNames()), values)
 	}
 	return tb.insertQuery
 }
 
-// Retorna una query update con el mismo orden que los nombres de los campos en la consulta SELECT
+// Retorna una query update que asigna cada columna por su nombre, con los valores en el orden de las columnas de la tabla
 func (tb *TableInfo) UpdateQuery() string {
 	if tb.updateQuery == "" {
 		// Generar las asignaciones de columnas para el SET
 		setClauses := []string{}
 		for i, column := range tb.Columns {
-			setClauses = append(setClauses, fmt.Sprintf("%s = $%d", column.Name, i+1))
+			setClauses = append(setClauses, fmt.Sprintf("%s = $%d", database.QuoteIdent(column.Name), i+1))
 		}
 		setClause := strings.Join(setClauses, ", ")
 
@@ -121,56 +358,126 @@ func (tb *TableInfo) UpdateQuery() string {
 		offset := len(tb.Columns) + 1 // Los placeholders del WHERE comienzan después de los SET
 		for _, column := range tb.Columns {
 			if column.IsPrimaryKey {
-				whereClauses = append(whereClauses, fmt.Sprintf("%s = $%d", column.Name, offset))
+				whereClauses = append(whereClauses, fmt.Sprintf("%s = $%d", database.QuoteIdent(column.Name), offset))
 				offset++
 			}
 		}
 		whereClause := strings.Join(whereClauses, " AND ")
 
 		// Construir la query completa
-		tb.updateQuery = fmt.Sprintf("UPDATE %s.%s SET %s WHERE %s", tb.Scheme, tb.Name, setClause, whereClause)
+		tb.updateQuery = fmt.Sprintf("UPDATE %s SET %s WHERE %s", tb.QuotedName(), setClause, whereClause)
 	}
 	return tb.updateQuery
 }
 
 func (tb *TableInfo) UpSertQuery(destinyTable string) string {
-	// Obtener los nombres de las columnas
-	columnNames := []string{}
-	for _, column := range tb.Columns {
-		columnNames = append(columnNames, column.Name)
-	}
-
 	// Crear la lista de columnas
-	columns := strings.Join(columnNames, ", ")
+	columns := database.QuoteIdentList(tb.ColumnNames())
 
 	// Determinar la clave primaria y construir la cláusula ON CONFLICT
-	primaryKeys := []string{}
-	for _, column := range tb.Columns {
-		if column.IsPrimaryKey {
-			primaryKeys = append(primaryKeys, column.Name)
-		}
-	}
-	if len(primaryKeys) == 0 {
+	if len(tb.PrimaryKey()) == 0 {
 		return fmt.Sprintf("Error: La tabla %s.%s no tiene claves primarias definidas.", tb.Scheme, tb.Name)
 	}
-	onConflictClause := fmt.Sprintf("ON CONFLICT (%s)", strings.Join(primaryKeys, ", "))
+
+	// Generar la subconsulta SELECT desde la tabla fuente
+	subQuery := fmt.Sprintf("SELECT %s FROM %s", columns, tb.QuotedName())
+
+	// Generar la consulta completa
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) %s %s;",
+		database.QuoteTable(destinyTable), columns, subQuery, tb.onConflictUpdate(),
+	)
+
+	return query
+}
+
+// Retorna INSERT INTO tabla (columnas) VALUES (...), (...) ON CONFLICT con count filas, con los valores de cada fila
+// en el orden de las columnas. Las filas cuya clave primaria ya existe se actualizan, igual que en UpSertQuery.
+// Retorna error si la tabla no tiene clave primaria
+func (tb *TableInfo) UpSertValuesQuery(count int) (string, error) {
+	if len(tb.PrimaryKey()) == 0 {
+		return "", fmt.Errorf("table %s has no primary key", tb.TableName())
+	}
+	return fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES %s %s",
+		tb.QuotedName(), database.QuoteIdentList(tb.ColumnNames()), valueRows(len(tb.Columns), count), tb.onConflictUpdate(),
+	), nil
+}
+
+// Retorna ($1, $2), ($3, $4),... con count filas de size valores, las filas van entre paréntesis aunque tengan un valor
+func valueRows(size, count int) string {
+	if size == 1 {
+		rows := make([]string, count)
+		for i := range rows {
+			rows[i] = fmt.Sprintf("($%d)", i+1)
+		}
+		return strings.Join(rows, ", ")
+	}
+	return KeyPlaceholders(size, count)
+}
+
+// Retorna la cláusula ON CONFLICT (clave primaria) DO UPDATE SET que reemplaza todas las columnas
+func (tb *TableInfo) onConflictUpdate() string {
+	onConflictClause := fmt.Sprintf("ON CONFLICT (%s)", database.QuoteIdentList(tb.PrimaryKey()))
 
 	// Construir la cláusula DO UPDATE SET
 	setClauses := []string{}
 	for _, column := range tb.Columns {
-		setClauses = append(setClauses, fmt.Sprintf("%s = EXCLUDED.%s", column.Name, column.Name))
+		quoted := database.QuoteIdent(column.Name)
+		setClauses = append(setClauses, fmt.Sprintf("%s = EXCLUDED.%s", quoted, quoted))
 	}
-	setClause := strings.Join(setClauses, ", ")
+	return fmt.Sprintf("%s DO UPDATE SET %s", onConflictClause, strings.Join(setClauses, ", "))
+}
 
-	// Generar la subconsulta SELECT desde la tabla fuente
-	subQuery := fmt.Sprintf("SELECT %s FROM %s", columns, tb.TableName())
+// Retorna CREATE SCHEMA IF NOT EXISTS del esquema de la tabla
+func (tb *TableInfo) CreateSchemaQuery() string {
+	return fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", database.QuoteIdent(tb.Scheme))
+}
 
-	// Generar la consulta completa
+// Retorna CREATE TABLE IF NOT EXISTS con las columnas, sus tipos, valores por defecto y la clave primaria de la tabla.
+// Las columnas enteras con nextval por defecto se crean como serial con su propia secuencia, y las identity como
+// GENERATED BY DEFAULT para que acepten los valores copiados. Los catálogos sin Type pierden la precisión de numeric
+// y de otros tipos con modificadores, ver ColumnInfo.Type
+func (tb *TableInfo) CreateTableQuery() (string, error) {
+	definitions := []string{}
+	for _, column := range tb.Columns {
+		if column.Type == "" && (column.DataType == "ARRAY" || column.DataType == "USER-DEFINED") {
+			return "", fmt.Errorf("column %s of %s has type %s, which cannot be created from the model", column.Name, tb.TableName(), column.DataType)
+		}
+		definition := fmt.Sprintf("%s %s", database.QuoteIdent(column.Name), column.createDefinition())
+		if !column.IsNullable {
+			definition += " NOT NULL"
+		}
+		definitions = append(definitions, definition)
+	}
+	if primaryKey := tb.PrimaryKey(); len(primaryKey) > 0 {
+		definitions = append(definitions, fmt.Sprintf("PRIMARY KEY (%s)", database.QuoteIdentList(primaryKey)))
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", tb.QuotedName(), strings.Join(definitions, ", ")), nil
+}
+
+// Retorna CREATE INDEX IF NOT EXISTS del indice sobre las columnas dadas de la tabla
+func (tb *TableInfo) CreateIndexQuery(index IndexInfo, columns []string) string {
+	unique := ""
+	if index.IsUnique {
+		unique = "UNIQUE "
+	}
+	return fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s (%s)", unique, database.QuoteIdent(index.Name), tb.QuotedName(), database.QuoteIdentList(columns))
+}
+
+// Retorna ALTER TABLE ... ADD CONSTRAINT con la clave foránea de la tabla
+func (tb *TableInfo) AddForeignKeyQuery(fk FKConstraintInfo) string {
 	query := fmt.Sprintf(
-		"INSERT INTO %s (%s) %s %s DO UPDATE SET %s;",
-		destinyTable, columns, subQuery, onConflictClause, setClause,
+		"ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s)",
+		tb.QuotedName(), database.QuoteIdent(fk.Name), database.QuoteIdent(fk.Local),
+		database.QuoteTable(fk.ReferencedTable), database.QuoteIdent(fk.Referenced),
 	)
-
+	if fk.OnUpdate != "" {
+		query += fmt.Sprintf(" ON UPDATE %s", fk.OnUpdate)
+	}
+	if fk.OnDelete != "" {
+		query += fmt.Sprintf(" ON DELETE %s", fk.OnDelete)
+	}
 	return query
 }
 
@@ -186,6 +493,10 @@ func (tb *TableInfo) String() string {
 	for _, constraint := range tb.Constraints {
 		sb.WriteString(fmt.Sprintf("  %s\n", constraint.String()))
 	}
+	sb.WriteString("Indexes:\n")
+	for _, index := range tb.Indexes {
+		sb.WriteString(fmt.Sprintf("  %s\n", index.String()))
+	}
 	return sb.String()
 }
 
@@ -195,6 +506,45 @@ type ColumnInfo struct {
 	LengthPrecision int    //Longitud o precision del tipo de dato de la columna
 	IsPrimaryKey    bool   //Si la columna es clave primaria
 	IsNullable      bool   //Si la columna acepta valores nulos
+	Type            string //Tipo completo de la columna, ej. numeric(10,2), vacío si el catálogo no lo tiene
+	Default         string //Expresión del valor por defecto, vacía si no tiene
+	Identity        string //ALWAYS o BY DEFAULT si la columna es identity, vacío si no lo es
+}
+
+// Retorna el tipo de la columna con su longitud si la tiene, ej. character varying(50)
+func (ci *ColumnInfo) TypeName() string {
+	if ci.LengthPrecision > 0 {
+		return fmt.Sprintf("%s(%d)", ci.DataType, ci.LengthPrecision)
+	}
+	return ci.DataType
+}
+
+// Tipos serial de los tipos enteros
+var serialTypes = map[string]string{
+	"smallint": "smallserial",
+	"integer":  "serial",
+	"bigint":   "bigserial",
+}
+
+// Retorna el tipo de la columna con su valor por defecto o identity para CREATE TABLE
+func (ci *ColumnInfo) createDefinition() string {
+	typeName := ci.Type
+	if typeName == "" {
+		typeName = ci.TypeName()
+	}
+	switch {
+	case ci.Identity != "":
+		return typeName + " GENERATED BY DEFAULT AS IDENTITY"
+	case strings.HasPrefix(ci.Default, "nextval("):
+		// La secuencia del origen no existe en el destino, serial crea una propia
+		if serial, ok := serialTypes[ci.DataType]; ok {
+			return serial
+		}
+		return typeName
+	case ci.Default != "":
+		return fmt.Sprintf("%s DEFAULT %s", typeName, ci.Default)
+	}
+	return typeName
 }
 
 // Método String() para ColumnInfo
@@ -204,7 +554,7 @@ func (ci *ColumnInfo) String() string {
 		primaryKeyText = " (Primary Key)"
 	}
 	notNullText := ""
-	if ci.IsNullable {
+	if !ci.IsNullable {
 		notNullText = "Not Null"
 	}
 	return fmt.Sprintf("Column: %s, Type: %s(%d)%s %s", ci.Name, ci.DataType, ci.LengthPrecision, primaryKeyText, notNullText)
@@ -228,6 +578,40 @@ func (ci *FKConstraintInfo) String() string {
 	)
 }
 
+type IndexInfo struct {
+	Name       string   //Nombre del indice
+	Columns    []string //Columnas del indice en orden
+	IsUnique   bool     //Si el indice es unico
+	IsPrimary  bool     //Si el indice respalda la clave primaria
+	Definition string   //Definicion CREATE INDEX del indice
+}
+
+// Método String() para IndexInfo
+func (ii *IndexInfo) String() string {
+	return fmt.Sprintf("Index: %s, Columns: %s, Unique: %t, Primary: %t", ii.Name, strings.Join(ii.Columns, ", "), ii.IsUnique, ii.IsPrimary)
+}
+
+// Retorna la definición del indice con CREATE INDEX IF NOT EXISTS, para crearlo solo si no existe
+func (ii *IndexInfo) CreateQuery() string {
+	if strings.HasPrefix(ii.Definition, "CREATE UNIQUE INDEX ") {
+		return strings.Replace(ii.Definition, "CREATE UNIQUE INDEX ", "CREATE UNIQUE INDEX IF NOT EXISTS ", 1)
+	}
+	return strings.Replace(ii.Definition, "CREATE INDEX ", "CREATE INDEX IF NOT EXISTS ", 1)
+}
+
+// Retorna true si las columnas dadas son las primeras columnas del indice
+func (ii *IndexInfo) Covers(columns ...string) bool {
+	if len(columns) > len(ii.Columns) {
+		return false
+	}
+	for i, column := range columns {
+		if ii.Columns[i] != column {
+			return false
+		}
+	}
+	return true
+}
+
 type Action string //Acciones a realizar a actualizar o eliminar
 
 const (
@@ -252,9 +636,13 @@ func GetTableInfo(db *sql.DB, tableName string) (*TableInfo, error) {
 
 	// Obtener columnas
 	columnsQuery := `
-        SELECT column_name, data_type, character_maximum_length
-        FROM information_schema.columns
+        SELECT column_name, data_type, character_maximum_length, is_nullable = 'YES',
+            format_type(a.atttypid, a.atttypmod), COALESCE(column_default, ''), COALESCE(identity_generation, '')
+        FROM information_schema.columns c
+        JOIN pg_catalog.pg_attribute a
+            ON a.attrelid = (quote_ident(table_schema) || '.' || quote_ident(table_name))::regclass AND a.attname = column_name
         WHERE table_schema || '.' || table_name = $1
+        ORDER BY c.ordinal_position
     `
 	rows, err := db.Query(columnsQuery, tableName)
 	if err != nil {
@@ -265,7 +653,7 @@ func GetTableInfo(db *sql.DB, tableName string) (*TableInfo, error) {
 	for rows.Next() {
 		var column ColumnInfo
 		var lengthPrecision sql.NullInt64
-		err := rows.Scan(&column.Name, &column.DataType, &lengthPrecision)
+		err := rows.Scan(&column.Name, &column.DataType, &lengthPrecision, &column.IsNullable, &column.Type, &column.Default, &column.Identity)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning columns: %w", err)
 		}
@@ -300,20 +688,73 @@ func GetTableInfo(db *sql.DB, tableName string) (*TableInfo, error) {
 		tableInfo.Constraints = append(tableInfo.Constraints, *constraintInfo)
 	}
 
+	// Obtener indices
+	indexes, err := GetIndexes(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	tableInfo.Indexes = indexes
+
 	return &tableInfo, nil
 }
 
+// Recibe por parámetro la base de datos (postgres) y el nombre de la tabla en la forma scheme.table y devuelve los indices de la tabla
+func GetIndexes(db *sql.DB, tableName string) ([]IndexInfo, error) {
+	query := `
+        SELECT
+            i.relname,
+            ix.indisunique,
+            ix.indisprimary,
+            pg_get_indexdef(ix.indexrelid),
+            ARRAY(
+                SELECT a.attname::text
+                FROM unnest(ix.indkey) WITH ORDINALITY AS k(attnum, ord)
+                JOIN pg_attribute AS a ON a.attrelid = ix.indrelid AND a.attnum = k.attnum
+                ORDER BY k.ord
+            )
+        FROM pg_index AS ix
+        JOIN pg_class AS t ON t.oid = ix.indrelid
+        JOIN pg_class AS i ON i.oid = ix.indexrelid
+        JOIN pg_namespace AS n ON n.oid = t.relnamespace
+        WHERE n.nspname || '.' || t.relname = $1
+        ORDER BY i.relname
+    `
+	rows, err := db.Query(query, tableName)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching indexes: %w", err)
+	}
+	defer rows.Close()
+
+	indexes := []IndexInfo{}
+	for rows.Next() {
+		var index IndexInfo
+		err := rows.Scan(&index.Name, &index.IsUnique, &index.IsPrimary, &index.Definition, pq.Array(&index.Columns))
+		if err != nil {
+			return nil, fmt.Errorf("error scanning indexes: %w", err)
+		}
+		indexes = append(indexes, index)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error fetching indexes: %w", err)
+	}
+	return indexes, nil
+}
+
 // Recibe por parámetro la base de datos (postgres) y el nombre de la tabla en la forma scheme.table, el nombre de la columna y devuelve la información de la columna
 func GetColumnInfo(db *sql.DB, tableName string, columnName string) (*ColumnInfo, error) {
 	var column ColumnInfo
 	query := `
-        SELECT column_name, data_type, character_maximum_length
-        FROM information_schema.columns
+        SELECT column_name, data_type, character_maximum_length, is_nullable = 'YES',
+            format_type(a.atttypid, a.atttypmod), COALESCE(column_default, ''), COALESCE(identity_generation, '')
+        FROM information_schema.columns c
+        JOIN pg_catalog.pg_attribute a
+            ON a.attrelid = (quote_ident(table_schema) || '.' || quote_ident(table_name))::regclass AND a.attname = column_name
         WHERE table_schema || '.' || table_name = $1
         AND column_name = $2
+        ORDER BY c.ordinal_position
     `
 	var lengthPrecision sql.NullInt64
-	err := db.QueryRow(query, tableName, columnName).Scan(&column.Name, &column.DataType, &lengthPrecision)
+	err := db.QueryRow(query, tableName, columnName).Scan(&column.Name, &column.DataType, &lengthPrecision, &column.IsNullable, &column.Type, &column.Default, &column.Identity)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching column info: %w", err)
 	}